@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Component statuses, from best to worst.
+var ComponentStatuses = []string{"operational", "degraded_performance", "partial_outage", "major_outage"}
+
+// ComponentRule is an entry in an app's "components" config. It sets a
+// StatusPage component's status from the bands a metric's value falls in.
+type ComponentRule struct {
+	Metric      string `json:"metric"`
+	ComponentId string `json:"component_id"`
+	// Thresholds maps a status to the value at which the component enters it.
+	Thresholds map[string]float64 `json:"thresholds"`
+	// Below is set for metrics where lower is worse, like apdex_score.
+	Below bool `json:"below"`
+	// StaleStatus is set on rules added by the Watchdog, which put the
+	// component in that status while the metric is stale, rather than
+	// looking at its value.
+	StaleStatus string `json:"-"`
+}
+
+// Status returns the worst status whose threshold the value has crossed.
+func (rule ComponentRule) Status(value float64) string {
+	for i := len(ComponentStatuses) - 1; i > 0; i-- {
+		threshold, ok := rule.Thresholds[ComponentStatuses[i]]
+		if !ok {
+			continue
+		}
+		if (!rule.Below && value >= threshold) || (rule.Below && value <= threshold) {
+			return ComponentStatuses[i]
+		}
+	}
+	return "operational"
+}
+
+func severity(status string) int {
+	for i, s := range ComponentStatuses {
+		if s == status {
+			return i
+		}
+	}
+	return -1
+}
+
+func validateComponents(app App) error {
+	for i, rule := range app.Components {
+		if _, ok := app.SPMetrics[rule.Metric]; !ok {
+			return configError(fmt.Sprintf("components[%d].metric", i), "unknown metric %q", rule.Metric)
+		}
+		if rule.ComponentId == "" {
+			return configError(fmt.Sprintf("components[%d].component_id", i), "missing")
+		}
+		if len(rule.Thresholds) == 0 {
+			return configError(fmt.Sprintf("components[%d].thresholds", i), "missing")
+		}
+		for status := range rule.Thresholds {
+			if severity(status) < 1 {
+				return configError(fmt.Sprintf("components[%d].thresholds", i), "unknown status %q", status)
+			}
+		}
+	}
+	return nil
+}
+
+// componentRulesFor returns the app's component rules that are driven by a
+// metric.
+func (app App) componentRulesFor(key string) []ComponentRule {
+	var rules []ComponentRule
+	for _, rule := range app.Components {
+		if rule.Metric == key {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+type SPComponentPayload struct {
+	Component SPComponent `json:"component"`
+}
+
+type SPComponent struct {
+	Status string `json:"status"`
+}
+
+// ComponentError is what a metric is settled with when one of its components
+// couldn't be updated. The metric's data points may well have been delivered
+// regardless, so the Queue doesn't send it again.
+type ComponentError struct {
+	Err error
+}
+
+func (e *ComponentError) Error() string {
+	return "components: " + e.Err.Error()
+}
+
+// ComponentDispatcher sets StatusPage component statuses from the metrics
+// passing through Dispatch. It remembers the status each metric last put a
+// component in, so that a component is only PATCHed when its status changes,
+// and a component driven by several metrics takes the worst of them.
+type ComponentDispatcher struct {
+	mu sync.Mutex
+	// statuses maps page/component to app/metric key to status.
+	statuses map[string]map[string]string
+	// current maps page/component to the status last sent to StatusPage.
+	current map[string]string
+}
+
+func NewComponentDispatcher() *ComponentDispatcher {
+	return &ComponentDispatcher{
+		statuses: make(map[string]map[string]string),
+		current:  make(map[string]string),
+	}
+}
+
+// Update evaluates the metric against its component rules, and PATCHes any
+// component whose status has changed as a result. It returns a ComponentError
+// for the first component that couldn't be updated, if any.
+func (d *ComponentDispatcher) Update(config Config, metric Metric) error {
+	// Initialise metrics
+	statuspageCounts.Add("components.changes", 0)
+
+	var failed error
+	for _, rule := range metric.Components {
+		id := metric.SPPageId + "/" + rule.ComponentId
+		// Apps sharing a page may well have metrics with the same key.
+		key, value := metric.App+"/"+metric.Key, rule.Status(metric.Value)
+		if rule.StaleStatus != "" {
+			key, value = "stale:"+key, "operational"
+			if metric.Stale {
+				value = rule.StaleStatus
+			}
+		} else if metric.Stale || metric.Sentinel {
+			// A stale value says nothing about how the component is doing.
+			continue
+		}
+		status := d.evaluate(id, key, value)
+		if status == "" {
+			continue
+		}
+
+		if config.Debug {
+			log.Printf("[debug] Dispatch: component %s is now %s (%s = %f)\n", id, status, metric.Key, metric.Value)
+		}
+		parts := []string{config.SPBaseURL, "pages", metric.SPPageId, "components", rule.ComponentId + ".json"}
+		url := strings.Join(parts, "/")
+		payload := SPComponentPayload{Component: SPComponent{Status: status}}
+		err := spRequest(config, "components.", "PATCH", url, metric.SPPageId, metric.SPApiKey, payload, nil)
+		if err != nil {
+			log.Printf("[error] Dispatch: component %s: %s\n", id, err)
+			d.forget(id)
+			if failed == nil {
+				failed = &ComponentError{Err: err}
+			}
+			continue
+		}
+		statuspageCounts.Add("components.changes", 1)
+		log.Printf("[info] Dispatch: component %s set to %s\n", id, status)
+	}
+	return failed
+}
+
+// evaluate records the status a metric puts a component in, and returns the
+// component's new status if it needs changing, or "" if it doesn't.
+func (d *ComponentDispatcher) evaluate(id string, key string, status string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.statuses[id] == nil {
+		d.statuses[id] = make(map[string]string)
+	}
+	d.statuses[id][key] = status
+
+	worst := "operational"
+	for _, s := range d.statuses[id] {
+		if severity(s) > severity(worst) {
+			worst = s
+		}
+	}
+	if current, ok := d.current[id]; ok && current == worst {
+		return ""
+	}
+	d.current[id] = worst
+	return worst
+}
+
+// forget drops what we think a component's status is, so it is sent again
+// next time.
+func (d *ComponentDispatcher) forget(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.current, id)
+}
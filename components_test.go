@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func MockStatusPageComponents(requests chan string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p SPComponentPayload
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &p)
+		requests <- r.Method + " " + r.URL.Path + " " + p.Component.Status
+		w.Write([]byte(`{}`))
+	}))
+	return ts
+}
+
+func TestComponentRuleStatus(t *testing.T) {
+	rule := ComponentRule{Thresholds: map[string]float64{"degraded_performance": 1, "major_outage": 10}}
+	cases := map[float64]string{0.5: "operational", 1: "degraded_performance", 9.9: "degraded_performance", 50: "major_outage"}
+	for value, expected := range cases {
+		if status := rule.Status(value); status != expected {
+			t.Fatalf("Expected %f to be %s, got %s", value, expected, status)
+		}
+	}
+
+	rule = ComponentRule{Below: true, Thresholds: map[string]float64{"degraded_performance": 0.85, "partial_outage": 0.5}}
+	cases = map[float64]string{0.95: "operational", 0.8: "degraded_performance", 0.3: "partial_outage"}
+	for value, expected := range cases {
+		if status := rule.Status(value); status != expected {
+			t.Fatalf("Expected %f to be %s, got %s", value, expected, status)
+		}
+	}
+}
+
+func TestComponentDispatcherOnlyPatchesChanges(t *testing.T) {
+	requests := make(chan string, 10)
+	sp := MockStatusPageComponents(requests)
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+	d := NewComponentDispatcher()
+	errors := ComponentRule{Metric: "error_rate", ComponentId: "api", Thresholds: map[string]float64{"partial_outage": 5}}
+	latency := ComponentRule{Metric: "response_time", ComponentId: "api", Thresholds: map[string]float64{"degraded_performance": 500}}
+
+	send := func(rule ComponentRule, value float64) {
+		d.Update(config, Metric{Key: rule.Metric, SPPageId: "page", Value: value, Components: []ComponentRule{rule}})
+	}
+	expect := func(expected string) {
+		select {
+		case request := <-requests:
+			if request != expected {
+				t.Fatalf("Expected '%s', got '%s'", expected, request)
+			}
+		default:
+			if expected != "" {
+				t.Fatalf("Expected '%s', got nothing", expected)
+			}
+		}
+	}
+
+	send(errors, 1)
+	expect("PATCH /v1/pages/page/components/api.json operational")
+	send(errors, 2)
+	expect("")
+	send(latency, 800)
+	expect("PATCH /v1/pages/page/components/api.json degraded_performance")
+	send(errors, 10)
+	expect("PATCH /v1/pages/page/components/api.json partial_outage")
+	send(errors, 0)
+	expect("PATCH /v1/pages/page/components/api.json degraded_performance")
+	send(latency, 100)
+	expect("PATCH /v1/pages/page/components/api.json operational")
+}
+
+func TestComponentDispatcherSharedByApps(t *testing.T) {
+	requests := make(chan string, 10)
+	sp := MockStatusPageComponents(requests)
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+	d := NewComponentDispatcher()
+	rule := ComponentRule{Metric: "error_rate", ComponentId: "api", Thresholds: map[string]float64{"partial_outage": 5}}
+
+	send := func(app string, value float64) {
+		d.Update(config, Metric{App: app, Key: "error_rate", SPPageId: "page", Value: value, Components: []ComponentRule{rule}})
+	}
+
+	send("web", 10)
+	if request := <-requests; request != "PATCH /v1/pages/page/components/api.json partial_outage" {
+		t.Fatalf("Expected the component to go to partial_outage, got '%s'", request)
+	}
+	// The other app being fine doesn't make the component operational, as
+	// long as the first app is still in trouble.
+	for i := 0; i < 3; i++ {
+		send("worker", 0)
+		send("web", 10)
+	}
+	select {
+	case request := <-requests:
+		t.Fatalf("Expected no more changes, got '%s'", request)
+	default:
+	}
+
+	send("web", 0)
+	if request := <-requests; request != "PATCH /v1/pages/page/components/api.json operational" {
+		t.Fatalf("Expected the component to go back to operational, got '%s'", request)
+	}
+}
+
+func TestAppValidateComponents(t *testing.T) {
+	app := App{SPPageId: "page", SPMetrics: map[string]MetricConfig{"error_rate": {SPMetricId: "err"}}}
+	app.Components = []ComponentRule{{Metric: "error_rate", ComponentId: "api", Thresholds: map[string]float64{"major_outage": 10}}}
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected app to be valid, got: %s", err)
+	}
+
+	app.Components[0].Thresholds = map[string]float64{"on_fire": 10}
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for unknown status 'on_fire', got nil")
+	}
+
+	app.Components = []ComponentRule{{Metric: "throughput", ComponentId: "api", Thresholds: map[string]float64{"major_outage": 10}}}
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for a rule on a metric the app doesn't fetch, got nil")
+	}
+}
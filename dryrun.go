@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var dryrunCounts = expvar.NewMap("dryrun")
+
+// DryRunFormats are the ways a dry run can print what would have been sent.
+var DryRunFormats = []string{"table", "json"}
+
+// DryRunLine is what a dry run prints for each metric and sink, in the json
+// format.
+type DryRunLine struct {
+	App        string    `json:"app"`
+	Sink       string    `json:"sink"`
+	Key        string    `json:"key"`
+	SPPageId   string    `json:"sp_page_id"`
+	SPMetricId string    `json:"sp_metric_id"`
+	Value      float64   `json:"value"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+const dryRunRow = "%-24s %-12s %-16s %-14s %-14s %14s %s\n"
+
+// DryRun prints what Dispatch would have sent to each sink, instead of
+// sending it.
+type DryRun struct {
+	mu      sync.Mutex
+	w       io.Writer
+	format  string
+	started bool
+}
+
+// NewDryRun returns a DryRun that prints to config.Output, or stdout.
+func NewDryRun(config Config) *DryRun {
+	w := config.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	return &DryRun{w: w, format: config.DryRunFormat}
+}
+
+// Print writes out the metric as it would have been sent to target.
+func (d *DryRun) Print(target SinkConfig, metric Metric) {
+	// Initialise metrics
+	dryrunCounts.Add("metrics", 0)
+	dryrunCounts.Add("sinks."+target.Type, 0)
+
+	line := DryRunLine{
+		App:        metric.App,
+		Sink:       target.Type,
+		Key:        metric.Key,
+		SPPageId:   metric.SPPageId,
+		SPMetricId: metric.SPMetricId,
+		Value:      metric.Value,
+		Timestamp:  metric.Time().UTC(),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.format == "json" {
+		body, _ := json.Marshal(line)
+		fmt.Fprintln(d.w, string(body))
+	} else {
+		if !d.started {
+			fmt.Fprintf(d.w, dryRunRow, "APP", "SINK", "KEY", "PAGE", "METRIC", "VALUE", "TIMESTAMP")
+			d.started = true
+		}
+		value := fmt.Sprintf("%g", line.Value)
+		fmt.Fprintf(d.w, dryRunRow, line.App, line.Sink, line.Key, line.SPPageId, line.SPMetricId, value, line.Timestamp.Format(time.RFC3339))
+	}
+	dryrunCounts.Add("metrics", 1)
+	dryrunCounts.Add("sinks."+target.Type, 1)
+}
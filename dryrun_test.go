@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRun(t *testing.T) {
+	observed := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	Sources["mock"] = MockSource{Metrics: []Metric{{Key: "a", SPPageId: "page", SPMetricId: "metric", Value: 1.5, Timestamp: observed}}}
+	defer delete(Sources, "mock")
+	app := App{
+		Source:     "mock",
+		URL:        "http://example.com/stats",
+		SPPageId:   "page",
+		SPMetrics:  map[string]MetricConfig{"a": {SPMetricId: "metric"}},
+		Components: []ComponentRule{{Metric: "a", ComponentId: "component", Thresholds: map[string]float64{"major_outage": 1}}},
+	}
+
+	sp, requests := MockFlakyStatusPage(0, 0, "")
+	defer sp.Close()
+
+	for _, format := range DryRunFormats {
+		var out bytes.Buffer
+		config := Config{SPBaseURL: sp.URL + "/v1", DryRun: true, DryRunFormat: format, Output: &out}
+		if status := Once(config, []App{app}, &bytes.Buffer{}); status != 0 {
+			t.Fatalf("Expected a dry run to succeed, got %d", status)
+		}
+		if *requests != 0 {
+			t.Fatalf("Expected a dry run not to send anything to StatusPage, got %d requests", *requests)
+		}
+
+		if format == "json" {
+			var line DryRunLine
+			if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+				t.Fatalf("Expected a line of JSON, got %q: %s", out.String(), err)
+			}
+			expected := DryRunLine{App: "http://example.com/stats", Sink: "statuspage", Key: "a", SPPageId: "page", SPMetricId: "metric", Value: 1.5, Timestamp: observed}
+			if line != expected {
+				t.Fatalf("Expected %+v, got %+v", expected, line)
+			}
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "APP") {
+			t.Fatalf("Expected a header and one row, got:\n%s", out.String())
+		}
+		for _, field := range []string{"http://example.com/stats", "statuspage", "page", "metric", "1.5", "2026-01-02T03:04:05Z"} {
+			if !strings.Contains(lines[1], field) {
+				t.Fatalf("Expected %q in the row, got: %s", field, lines[1])
+			}
+		}
+	}
+}
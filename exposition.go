@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The /metrics endpoint serves Nudger's expvar counters, and a few metrics of
+// its own, in the Prometheus text format.
+func init() {
+	http.HandleFunc("/metrics", ServePrometheus)
+}
+
+// LatencyBuckets are the upper bounds, in seconds, of the request latency
+// histograms.
+var LatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	requestLatency = NewHistogramVec("nudger_request_duration_seconds", "How long requests to upstream APIs took.", LatencyBuckets, "service")
+	fetchedCounts  = NewCounterVec("nudger_metrics_fetched_total", "Metrics fetched from a source.", "app", "metric")
+	pollErrors     = NewCounterVec("nudger_poll_errors_total", "Polls that fetched nothing.", "app", "source")
+	submitCounts   = NewCounterVec("nudger_submissions_total", "Metrics submitted to a sink, by outcome.", "sink", "app", "page", "metric", "outcome")
+)
+
+// recordSubmission counts a metric's submission to a sink, by how it went,
+// and notes it in the metric's status.
+func recordSubmission(target SinkConfig, metric Metric, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	submitCounts.Add(1, target.Type, metric.App, metric.SPPageId, metric.Key, outcome)
+	statuses.Submitted(metric, err)
+	if err == nil {
+		health.Dispatched()
+	}
+}
+
+// labelled keeps the series of a labelled metric in the order they appeared.
+type labelled struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string][]string
+}
+
+func (l *labelled) key(values []string) string {
+	key := strings.Join(values, "\x00")
+	if _, ok := l.series[key]; !ok {
+		l.series[key] = values
+	}
+	return key
+}
+
+func (l *labelled) keys() []string {
+	keys := make([]string, 0, len(l.series))
+	for key := range l.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (l *labelled) labelString(key string, extra ...string) string {
+	var pairs []string
+	for i, value := range l.series[key] {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l.labels[i], value))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a counter broken down by labels, for /metrics.
+type CounterVec struct {
+	labelled
+	values map[string]float64
+}
+
+var counterVecs []*CounterVec
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		labelled: labelled{name: name, help: help, labels: labels, series: make(map[string][]string)},
+		values:   make(map[string]float64),
+	}
+	counterVecs = append(counterVecs, c)
+	return c
+}
+
+// Add adds n to the series with the given label values.
+func (c *CounterVec) Add(n float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(values)] += n
+}
+
+func (c *CounterVec) write(w *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range c.keys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(key), formatFloat(c.values[key]))
+	}
+}
+
+// HistogramVec is a histogram broken down by labels, for /metrics.
+type HistogramVec struct {
+	labelled
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+var histogramVecs []*HistogramVec
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		labelled: labelled{name: name, help: help, labels: labels, series: make(map[string][]string)},
+		buckets:  buckets,
+		counts:   make(map[string][]uint64),
+		sums:     make(map[string]float64),
+		totals:   make(map[string]uint64),
+	}
+	histogramVecs = append(histogramVecs, h)
+	return h
+}
+
+// Observe records a value in the series with the given label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := h.key(values)
+	if h.counts[key] == nil {
+		h.counts[key] = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[key][i]++
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+// Since records the time since start, in seconds.
+func (h *HistogramVec) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *HistogramVec) write(w *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range h.keys() {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(bound)), h.counts[key][i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), h.totals[key])
+	}
+}
+
+// serviceName returns the name counts is published under in expvar, so that
+// code that is handed a service's counts can label what it measures with it.
+func serviceName(counts *expvar.Map) string {
+	var name string
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Value == counts {
+			name = kv.Key
+		}
+	})
+	return name
+}
+
+// labelPrefixes pick out expvar keys that name something, like a page or
+// metric, and which label it goes under.
+var labelPrefixes = map[string][][2]string{
+	"newrelic":  {{"apps.", "metric"}},
+	"ratelimit": {{"waiting.", "page"}},
+	"dryrun":    {{"sinks.", "sink"}},
+}
+
+// Gauges lists the expvar keys that go up and down, rather than count.
+var Gauges = map[string]bool{
+	"queue.depth":              true,
+	"queue.inflight":           true,
+	"queue.oldest_age_seconds": true,
+	"ratelimit.waiting":        true,
+	"pool.busy":                true,
+	"pool.pending":             true,
+	"config.apps":              true,
+}
+
+var unsafeName = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// promSample translates an expvar key into a Prometheus metric name and
+// labels, e.g. "errors.http.do" in the "newrelic" map becomes
+// nudger_newrelic_errors_total{class="http.do"}.
+func promSample(service string, key string) (name string, labels string, gauge bool) {
+	var pairs []string
+	for _, prefix := range labelPrefixes[service] {
+		if strings.HasPrefix(key, prefix[0]) {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", prefix[1], strings.TrimPrefix(key, prefix[0])))
+			key = strings.TrimSuffix(prefix[0], ".")
+			break
+		}
+	}
+	gauge = Gauges[service+"."+key]
+
+	if i := strings.Index(key, "errors."); i == 0 || i > 0 && key[i-1] == '.' {
+		pairs = append(pairs, fmt.Sprintf("class=%q", key[i+len("errors."):]))
+		key = key[:i] + "errors"
+	}
+
+	name = "nudger_" + unsafeName.ReplaceAllString(service+"_"+key, "_")
+	if !gauge {
+		name += "_total"
+	}
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+	return name, labels, gauge
+}
+
+// ServePrometheus serves /metrics.
+func ServePrometheus(w http.ResponseWriter, r *http.Request) {
+	var out bytes.Buffer
+
+	type family struct {
+		gauge   bool
+		samples []string
+	}
+	families := make(map[string]*family)
+	expvar.Do(func(kv expvar.KeyValue) {
+		counts, ok := kv.Value.(*expvar.Map)
+		if !ok {
+			return
+		}
+		counts.Do(func(v expvar.KeyValue) {
+			value, err := strconv.ParseFloat(v.Value.String(), 64)
+			if err != nil {
+				return
+			}
+			name, labels, gauge := promSample(kv.Key, v.Key)
+			if families[name] == nil {
+				families[name] = &family{gauge: gauge}
+			}
+			families[name].samples = append(families[name].samples, name+labels+" "+formatFloat(value))
+		})
+	})
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		kind := "counter"
+		if families[name].gauge {
+			kind = "gauge"
+		}
+		fmt.Fprintf(&out, "# TYPE %s %s\n", name, kind)
+		sort.Strings(families[name].samples)
+		for _, sample := range families[name].samples {
+			fmt.Fprintln(&out, sample)
+		}
+	}
+
+	for _, c := range counterVecs {
+		c.write(&out)
+	}
+	for _, h := range histogramVecs {
+		h.write(&out)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(out.Bytes())
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromSample(t *testing.T) {
+	for _, c := range []struct {
+		service, key string
+		name, labels string
+		gauge        bool
+	}{
+		{"newrelic", "requests", "nudger_newrelic_requests_total", "", false},
+		{"newrelic", "errors.http.do", "nudger_newrelic_errors_total", `{class="http.do"}`, false},
+		{"newrelic", "apps.error_rate", "nudger_newrelic_apps_total", `{metric="error_rate"}`, false},
+		{"statuspage", "bulk.errors.http.status", "nudger_statuspage_bulk_errors_total", `{class="http.status"}`, false},
+		{"statuspage", "components.changes", "nudger_statuspage_components_changes_total", "", false},
+		{"ratelimit", "waiting.abc123", "nudger_ratelimit_waiting", `{page="abc123"}`, true},
+		{"queue", "depth", "nudger_queue_depth", "", true},
+	} {
+		name, labels, gauge := promSample(c.service, c.key)
+		if name != c.name || labels != c.labels || gauge != c.gauge {
+			t.Errorf("Expected %s %s to be %s%s (gauge: %t), got %s%s (gauge: %t)", c.service, c.key, c.name, c.labels, c.gauge, name, labels, gauge)
+		}
+	}
+}
+
+func TestServePrometheus(t *testing.T) {
+	newrelicCounts.Add("errors.http.do", 0)
+	latency := NewHistogramVec("nudger_test_duration_seconds", "A test histogram.", []float64{0.1, 1}, "service")
+	latency.Observe(0.5, "statuspage")
+	latency.Observe(2, "statuspage")
+	submissions := NewCounterVec("nudger_test_total", "A test counter.", "page")
+	submissions.Add(3, "page")
+
+	rec := httptest.NewRecorder()
+	ServePrometheus(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, expected := range []string{
+		"# TYPE nudger_newrelic_errors_total counter\n",
+		`nudger_newrelic_errors_total{class="http.do"} `,
+		"# TYPE nudger_queue_depth gauge\n",
+		"# TYPE nudger_test_duration_seconds histogram\n",
+		`nudger_test_duration_seconds_bucket{service="statuspage",le="0.1"} 0` + "\n",
+		`nudger_test_duration_seconds_bucket{service="statuspage",le="1"} 1` + "\n",
+		`nudger_test_duration_seconds_bucket{service="statuspage",le="+Inf"} 2` + "\n",
+		`nudger_test_duration_seconds_sum{service="statuspage"} 2.5` + "\n",
+		`nudger_test_duration_seconds_count{service="statuspage"} 2` + "\n",
+		`nudger_test_total{page="page"} 3` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Expected %q in /metrics, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestRequestLatencyIsRecorded(t *testing.T) {
+	sp, _ := MockFlakyStatusPage(0, 0, "")
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1", Timeout: time.Second}
+	if err := (StatusPage{}).Publish(config, SinkConfig{}, Metric{SPPageId: "page", SPMetricId: "metric"}); err != nil {
+		t.Fatal(err)
+	}
+	requestLatency.mu.Lock()
+	defer requestLatency.mu.Unlock()
+	if requestLatency.totals[requestLatency.key([]string{"statuspage"})] == 0 {
+		t.Fatal("Expected the StatusPage request to be timed")
+	}
+}
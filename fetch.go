@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// FetchTimeout bounds how long a source waits on the system it polls.
+const FetchTimeout = time.Second * 5
+
+// fetchJSON GETs url and decodes the JSON response into v, counting requests
+// and failures in counts the same way for every source. It returns the HTTP
+// status of the response. A response that isn't a 2xx is counted under
+// errors.http.status rather than returned as an error, and decoded if it can
+// be, so that sources can report the error the upstream sent; error pages
+// that aren't JSON are left undecoded.
+func fetchJSON(config Config, counts *expvar.Map, prefix string, url string, header http.Header, v interface{}) (int, error) {
+	return requestJSON(config, counts, prefix, "GET", url, header, nil, v)
+}
+
+// postJSON is fetchJSON for APIs that take a JSON request body, like GraphQL.
+func postJSON(config Config, counts *expvar.Map, prefix string, url string, header http.Header, payload interface{}, v interface{}) (int, error) {
+	counts.Add("errors.json.marshal", 0)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		counts.Add("errors.json.marshal", 1)
+		return 0, fmt.Errorf("JSON marshal: %s", err)
+	}
+	if config.Debug {
+		log.Printf("[debug] %s: JSON marshal: %s\n", prefix, body)
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return requestJSON(config, counts, prefix, "POST", url, header, body, v)
+}
+
+func requestJSON(config Config, counts *expvar.Map, prefix string, method string, url string, header http.Header, payload []byte, v interface{}) (int, error) {
+	// Initialise metrics
+	counts.Add("errors.http.new", 0)
+	counts.Add("errors.http.do", 0)
+	counts.Add("errors.http.readbody", 0)
+	counts.Add("errors.http.status", 0)
+	counts.Add("errors.json.decode", 0)
+	counts.Add("requests", 0)
+
+	if config.Debug {
+		log.Printf("[debug] %s: URL: %s\n", prefix, url)
+	}
+
+	client := &http.Client{Timeout: FetchTimeout}
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		counts.Add("errors.http.new", 1)
+		return 0, fmt.Errorf("new request: %s", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	requestLatency.Since(start, serviceName(counts))
+	if err != nil {
+		counts.Add("errors.http.do", 1)
+		return 0, fmt.Errorf("client do: %s", err)
+	}
+	defer resp.Body.Close()
+	counts.Add("requests", 1)
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		counts.Add("errors.http.readbody", 1)
+		return resp.StatusCode, fmt.Errorf("couldn't read body: %s", err)
+	}
+
+	if config.Debug {
+		log.Printf("[debug] %s raw body: %s\n", prefix, raw)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		counts.Add("errors.http.status", 1)
+		_ = json.Unmarshal(raw, v)
+		return resp.StatusCode, nil
+	}
+
+	err = json.Unmarshal(raw, v)
+	if err != nil {
+		counts.Add("errors.json.decode", 1)
+		return resp.StatusCode, fmt.Errorf("couldn't decode json: %s, raw body: %s", err, raw)
+	}
+	if config.Debug {
+		log.Printf("[debug] %s decoded JSON: %+v\n", prefix, v)
+	}
+	return resp.StatusCode, nil
+}
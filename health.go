@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DispatchStall is how long Dispatch can go without taking a breath before
+// Nudger is no longer considered healthy.
+const DispatchStall = 30 * time.Second
+
+// Health tracks what /healthz and /readyz report.
+type Health struct {
+	mu           sync.Mutex
+	configLoaded bool
+	dispatching  bool
+	beat         time.Time
+	polled       time.Time
+	dispatched   time.Time
+}
+
+var health = &Health{}
+
+// ConfigLoaded records that a valid config has been loaded.
+func (h *Health) ConfigLoaded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.configLoaded = true
+}
+
+// Dispatching records whether Dispatch is running.
+func (h *Health) Dispatching(running bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dispatching = running
+	h.beat = time.Now()
+}
+
+// Beat records that Dispatch isn't stuck.
+func (h *Health) Beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.beat = time.Now()
+}
+
+// Polled records a successful poll.
+func (h *Health) Polled() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.polled = time.Now()
+}
+
+// Dispatched records a metric successfully sent on to a sink.
+func (h *Health) Dispatched() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dispatched = time.Now()
+}
+
+// Live returns why Nudger needs restarting, if it does.
+func (h *Health) Live() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dispatching {
+		return fmt.Errorf("dispatch isn't running")
+	}
+	if stalled := time.Since(h.beat); stalled > DispatchStall {
+		return fmt.Errorf("dispatch has been stuck for %s", stalled.Round(time.Second))
+	}
+	return nil
+}
+
+// Ready returns why Nudger isn't doing its job, if it isn't: it needs a
+// config, and to have polled and dispatched something within window.
+func (h *Health) Ready(window time.Duration) error {
+	if err := h.Live(); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.configLoaded {
+		return fmt.Errorf("no config loaded")
+	}
+	if h.polled.IsZero() || time.Since(h.polled) > window {
+		return fmt.Errorf("no successful poll in the last %s", window)
+	}
+	if h.dispatched.IsZero() || time.Since(h.dispatched) > window {
+		return fmt.Errorf("nothing dispatched in the last %s", window)
+	}
+	return nil
+}
+
+// ServeHealthz serves /healthz: 200 while the process is working, and 503 if
+// it is wedged and should be restarted.
+func ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	serveHealth(w, health.Live())
+}
+
+// ServeReadyz returns the handler for /readyz: 200 while metrics are flowing
+// from sources to sinks, and 503 otherwise.
+func ServeReadyz(config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, health.Ready(config.ReadyWindow))
+	}
+}
+
+func serveHealth(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	h := &Health{}
+	if err := h.Live(); err == nil {
+		t.Fatal("Expected not to be live before Dispatch starts")
+	}
+	h.Dispatching(true)
+	if err := h.Live(); err != nil {
+		t.Fatalf("Expected to be live once Dispatch starts, got: %s", err)
+	}
+	h.beat = time.Now().Add(-2 * DispatchStall)
+	if err := h.Live(); err == nil || !strings.Contains(err.Error(), "stuck") {
+		t.Fatalf("Expected a stuck Dispatch not to be live, got: %v", err)
+	}
+	h.Beat()
+
+	for _, step := range []struct {
+		do     func()
+		reason string
+	}{
+		{func() {}, "no config"},
+		{h.ConfigLoaded, "no successful poll"},
+		{h.Polled, "nothing dispatched"},
+		{h.Dispatched, ""},
+	} {
+		step.do()
+		err := h.Ready(time.Minute)
+		if step.reason == "" {
+			if err != nil {
+				t.Fatalf("Expected to be ready, got: %s", err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), step.reason) {
+			t.Fatalf("Expected not to be ready because of %q, got: %v", step.reason, err)
+		}
+	}
+
+	h.polled = time.Now().Add(-2 * time.Minute)
+	if err := h.Ready(time.Minute); err == nil {
+		t.Fatal("Expected not to be ready when the last poll is too old")
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ServeReadyz(Config{ReadyWindow: time.Nanosecond})(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != 503 {
+		t.Fatalf("Expected /readyz to be 503 when nothing has happened lately, got %d", rec.Code)
+	}
+
+	metrics := make(chan Metric)
+	go Dispatch(Config{}, metrics)
+	defer close(metrics)
+	deadline := time.Now().Add(time.Second)
+	for {
+		rec = httptest.NewRecorder()
+		ServeHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+		if rec.Code == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected /healthz to be 200 while Dispatch runs, got %d: %s", rec.Code, rec.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
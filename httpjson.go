@@ -0,0 +1,139 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var httpjsonCounts = expvar.NewMap("httpjson")
+
+// HTTPJSON is the Source that GETs an arbitrary JSON document, such as a
+// service's /stats endpoint, and extracts each metric from it with a path.
+type HTTPJSON struct{}
+
+// Validate checks that the app says where to fetch from, and that every metric
+// has a path that parses.
+func (HTTPJSON) Validate(app App) error {
+	if app.URL == "" {
+		return configError("url", "missing")
+	}
+	for _, key := range app.MetricKeys() {
+		path := app.SPMetrics[key].Path
+		if path == "" {
+			return configError("metrics."+key, "missing path")
+		}
+		if _, err := ParsePath(path); err != nil {
+			return configError("metrics."+key, "%s", err)
+		}
+	}
+	return nil
+}
+
+func (HTTPJSON) Fetch(config Config, app App) ([]Metric, error) {
+	// Initialise metrics
+	httpjsonCounts.Add("errors.path", 0)
+
+	header := http.Header{}
+	for name, value := range app.Headers {
+		header.Set(name, value)
+	}
+
+	var doc interface{}
+	status, err := fetchJSON(config, httpjsonCounts, "PollHTTPJSON", app.URL, header, &doc)
+	if err != nil {
+		return nil, err
+	}
+	observed := time.Now()
+	if status < 200 || status > 299 {
+		return nil, fmt.Errorf("%s returned HTTP %d", app.URL, status)
+	}
+
+	var metrics []Metric
+	for _, key := range app.MetricKeys() {
+		value, err := Extract(doc, app.SPMetrics[key].Path)
+		if err != nil {
+			log.Printf("[error] PollHTTPJSON: metric %s: %s\n", key, err)
+			httpjsonCounts.Add("errors.path", 1)
+			continue
+		}
+		if config.Debug {
+			log.Printf("[debug] PollHTTPJSON: %s = %f\n", key, value)
+		}
+		metrics = append(metrics, Metric{
+			Key:        key,
+			SPApiKey:   app.SPApiKey,
+			SPPageId:   app.SPPageId,
+			SPMetricId: app.SPMetrics[key].SPMetricId,
+			Value:      value,
+			Timestamp:  observed,
+		})
+	}
+	return metrics, nil
+}
+
+// ParsePath splits a dot-path like "$.stats.servers[0].latency" (or
+// "stats.servers.0.latency") into its object keys and array indexes.
+func ParsePath(path string) ([]string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.Replace(path, "[", ".", -1)
+	path = strings.Replace(path, "]", "", -1)
+	if path == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+	steps := strings.Split(path, ".")
+	for _, step := range steps {
+		if step == "" {
+			return nil, fmt.Errorf("malformed path %q", path)
+		}
+	}
+	return steps, nil
+}
+
+// Extract follows path through a decoded JSON document and returns the number
+// it finds there. Numeric strings are accepted, as plenty of /stats endpoints
+// quote their numbers, but not "NaN" or "Inf", which can't be sent on as JSON.
+func Extract(doc interface{}, path string) (float64, error) {
+	steps, err := ParsePath(path)
+	if err != nil {
+		return 0, err
+	}
+
+	node := doc
+	for i, step := range steps {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			next, ok := n[step]
+			if !ok {
+				return 0, fmt.Errorf("%s: no key %q", path, strings.Join(steps[:i+1], "."))
+			}
+			node = next
+		case []interface{}:
+			index, err := strconv.Atoi(step)
+			if err != nil || index < 0 || index >= len(n) {
+				return 0, fmt.Errorf("%s: no index %q", path, strings.Join(steps[:i+1], "."))
+			}
+			node = n[index]
+		default:
+			return 0, fmt.Errorf("%s: %q is not an object or array", path, strings.Join(steps[:i], "."))
+		}
+	}
+
+	switch v := node.(type) {
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("%s: %q is not a number", path, v)
+		}
+		return f, nil
+	default:
+		return 0, fmt.Errorf("%s: %v is not a number", path, node)
+	}
+}
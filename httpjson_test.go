@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPJSONFetch(t *testing.T) {
+	stats := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer hello" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"latency": {"p95": 123.4}, "queues": [{"depth": "7"}], "name": "api"}`))
+	}))
+	defer stats.Close()
+
+	app := App{
+		Source:   "httpjson",
+		URL:      stats.URL,
+		Headers:  map[string]string{"Authorization": "Bearer hello"},
+		SPPageId: "page",
+		SPMetrics: map[string]MetricConfig{
+			"latency": {SPMetricId: "lat", Path: "$.latency.p95"},
+			"depth":   {SPMetricId: "depth", Path: "queues[0].depth"},
+			"name":    {SPMetricId: "name", Path: "name"},
+		},
+	}
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected app to be valid, got: %s", err)
+	}
+	metrics, err := HTTPJSON{}.Fetch(Config{}, app)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	expected := map[string]float64{"lat": 123.4, "depth": 7}
+	if len(metrics) != len(expected) {
+		t.Fatalf("Expected %d metrics, got: %+v", len(expected), metrics)
+	}
+	for _, m := range metrics {
+		if m.Value != expected[m.SPMetricId] {
+			t.Fatalf("Expected %s to be %f, got %f", m.SPMetricId, expected[m.SPMetricId], m.Value)
+		}
+	}
+
+	app.Headers = nil
+	if _, err := (HTTPJSON{}).Fetch(Config{}, app); err == nil {
+		t.Fatal("Expected an error for HTTP 401, got nil")
+	}
+}
+
+func TestHTTPJSONErrorPage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`<html><body>Bad Gateway</body></html>`))
+	}))
+	defer ts.Close()
+
+	app := App{Source: "httpjson", URL: ts.URL, SPMetrics: map[string]MetricConfig{"lat": {SPMetricId: "lat", Path: "latency"}}}
+	status := counterValue(httpjsonCounts, "errors.http.status")
+	decode := counterValue(httpjsonCounts, "errors.json.decode")
+	if _, err := (HTTPJSON{}).Fetch(Config{}, app); err == nil || !strings.Contains(err.Error(), "HTTP 502") {
+		t.Fatalf("Expected an error for HTTP 502, got: %v", err)
+	}
+	if after := counterValue(httpjsonCounts, "errors.http.status"); after != status+1 {
+		t.Fatalf("Expected errors.http.status to go from %d to %d, got %d", status, status+1, after)
+	}
+	if after := counterValue(httpjsonCounts, "errors.json.decode"); after != decode {
+		t.Fatalf("Expected errors.json.decode to stay at %d, got %d", decode, after)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"a": {"b": [1, 2, {"c": 3}]}, "nan": "NaN", "inf": "+Infinity"}`), &doc)
+
+	cases := map[string]float64{
+		"a.b.0":     1,
+		"$.a.b[1]":  2,
+		"a.b[2].c":  3,
+		"$.a.b.2.c": 3,
+	}
+	for path, expected := range cases {
+		value, err := Extract(doc, path)
+		if err != nil {
+			t.Fatalf("%s: expected %f, got error: %s", path, expected, err)
+		}
+		if value != expected {
+			t.Fatalf("%s: expected %f, got %f", path, expected, value)
+		}
+	}
+
+	for _, path := range []string{"a.c", "a.b[3]", "a.b", "a..b", "", "nan", "inf"} {
+		if _, err := Extract(doc, path); err == nil {
+			t.Fatalf("%s: expected an error, got nil", path)
+		}
+	}
+}
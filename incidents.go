@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	DefaultIncidentName         = "Elevated {{.Key}}"
+	DefaultIncidentBody         = "We are investigating elevated {{.Key}} ({{.Value}})."
+	DefaultIncidentResolvedBody = "{{.Key}} has returned to normal ({{.Value}}). This incident has been resolved."
+)
+
+// IncidentRule is an entry in an app's "incidents" config. It opens a
+// StatusPage incident once a metric has crossed a threshold for BreachPolls
+// polls in a row, and resolves it once the metric has been back on the right
+// side of it for RecoverPolls polls in a row.
+type IncidentRule struct {
+	Metric    string  `json:"metric"`
+	Threshold float64 `json:"threshold"`
+	// Below is set for metrics where lower is worse, like apdex_score.
+	Below        bool `json:"below"`
+	BreachPolls  int  `json:"breach_polls"`
+	RecoverPolls int  `json:"recover_polls"`
+
+	// Name, Body and ResolvedBody are text/template strings, executed with
+	// the IncidentData of the metric that opened or resolved the incident.
+	Name         string `json:"name"`
+	Body         string `json:"body"`
+	ResolvedBody string `json:"resolved_body"`
+
+	// Components are marked with ComponentStatus while the incident is open.
+	ComponentIds    []string `json:"component_ids"`
+	ComponentStatus string   `json:"component_status"`
+}
+
+// IncidentData is what incident templates are executed with.
+type IncidentData struct {
+	Key       string
+	Value     float64
+	Threshold float64
+	SPPageId  string
+}
+
+// Breached returns whether the value is on the wrong side of the threshold.
+func (rule IncidentRule) Breached(value float64) bool {
+	if rule.Below {
+		return value <= rule.Threshold
+	}
+	return value >= rule.Threshold
+}
+
+func (rule IncidentRule) breachPolls() int {
+	if rule.BreachPolls < 1 {
+		return 1
+	}
+	return rule.BreachPolls
+}
+
+func (rule IncidentRule) recoverPolls() int {
+	if rule.RecoverPolls < 1 {
+		return 1
+	}
+	return rule.RecoverPolls
+}
+
+func (rule IncidentRule) render(text string, fallback string, data IncidentData) (string, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New("incident").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func validateIncidents(app App) error {
+	for i, rule := range app.Incidents {
+		if _, ok := app.SPMetrics[rule.Metric]; !ok {
+			return configError(fmt.Sprintf("incidents[%d].metric", i), "unknown metric %q", rule.Metric)
+		}
+		if rule.BreachPolls < 0 || rule.RecoverPolls < 0 {
+			return configError(fmt.Sprintf("incidents[%d]", i), "breach_polls and recover_polls can't be negative")
+		}
+		if rule.ComponentStatus != "" && severity(rule.ComponentStatus) < 1 {
+			return configError(fmt.Sprintf("incidents[%d].component_status", i), "unknown status %q", rule.ComponentStatus)
+		}
+		for _, text := range []string{rule.Name, rule.Body, rule.ResolvedBody} {
+			if _, err := rule.render(text, "", IncidentData{}); err != nil {
+				return configError(fmt.Sprintf("incidents[%d]", i), "%s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// incidentRulesFor returns the app's incident rules that are driven by a
+// metric.
+func (app App) incidentRulesFor(key string) []IncidentRule {
+	var rules []IncidentRule
+	for _, rule := range app.Incidents {
+		if rule.Metric == key {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+type SPIncidentPayload struct {
+	Incident SPIncident `json:"incident"`
+}
+
+type SPIncident struct {
+	Id           string            `json:"id,omitempty"`
+	Name         string            `json:"name,omitempty"`
+	Status       string            `json:"status,omitempty"`
+	Body         string            `json:"body,omitempty"`
+	ComponentIds []string          `json:"component_ids,omitempty"`
+	Components   map[string]string `json:"components,omitempty"`
+}
+
+// incidentState is what IncidentDispatcher remembers about a rule between
+// polls.
+type incidentState struct {
+	breaches   int
+	recoveries int
+	// incidentId is set while the rule has an incident open.
+	incidentId string
+}
+
+// IncidentDispatcher opens and resolves StatusPage incidents from the
+// metrics passing through Dispatch, tracking each rule's run of breaching
+// and recovered polls so that an incident is only opened once per breach.
+type IncidentDispatcher struct {
+	mu sync.Mutex
+	// states is keyed by page, app, and the whole rule, so that several
+	// rules on one metric, like a warning and a critical one, each keep
+	// their own count.
+	states map[string]*incidentState
+}
+
+func NewIncidentDispatcher() *IncidentDispatcher {
+	return &IncidentDispatcher{states: make(map[string]*incidentState)}
+}
+
+// Update counts the metric against its incident rules, and opens or resolves
+// incidents for any rule that has had enough polls in a row.
+func (d *IncidentDispatcher) Update(config Config, metric Metric) {
+	// Initialise metrics
+	statuspageCounts.Add("incidents.opened", 0)
+	statuspageCounts.Add("incidents.resolved", 0)
+
+	if metric.Stale || metric.Sentinel {
+		return
+	}
+	for _, rule := range metric.Incidents {
+		d.mu.Lock()
+		// Apps sharing a page may well have rules on the same metric.
+		id := metric.SPPageId + "/" + metric.App + "/" + rule.Metric + "/" + rule.Name
+		key := fmt.Sprintf("%s/%s/%+v", metric.SPPageId, metric.App, rule)
+		state, ok := d.states[key]
+		if !ok {
+			state = &incidentState{}
+			d.states[key] = state
+		}
+		if rule.Breached(metric.Value) {
+			state.breaches++
+			state.recoveries = 0
+		} else {
+			state.recoveries++
+			state.breaches = 0
+		}
+		open := state.incidentId == "" && state.breaches >= rule.breachPolls()
+		resolve := state.incidentId != "" && state.recoveries >= rule.recoverPolls()
+		incidentId := state.incidentId
+		d.mu.Unlock()
+
+		data := IncidentData{Key: metric.Key, Value: metric.Value, Threshold: rule.Threshold, SPPageId: metric.SPPageId}
+		switch {
+		case open:
+			incidentId, err := d.open(config, metric, rule, data)
+			if err != nil {
+				log.Printf("[error] Dispatch: opening incident for %s: %s\n", id, err)
+				continue
+			}
+			d.mu.Lock()
+			state.incidentId = incidentId
+			d.mu.Unlock()
+			statuspageCounts.Add("incidents.opened", 1)
+			log.Printf("[info] Dispatch: opened incident %s for %s\n", incidentId, id)
+		case resolve:
+			if err := d.resolve(config, metric, rule, incidentId, data); err != nil {
+				log.Printf("[error] Dispatch: resolving incident %s for %s: %s\n", incidentId, id, err)
+				continue
+			}
+			d.mu.Lock()
+			state.incidentId = ""
+			d.mu.Unlock()
+			statuspageCounts.Add("incidents.resolved", 1)
+			log.Printf("[info] Dispatch: resolved incident %s for %s\n", incidentId, id)
+		}
+	}
+}
+
+func (d *IncidentDispatcher) open(config Config, metric Metric, rule IncidentRule, data IncidentData) (string, error) {
+	name, err := rule.render(rule.Name, DefaultIncidentName, data)
+	if err != nil {
+		return "", err
+	}
+	body, err := rule.render(rule.Body, DefaultIncidentBody, data)
+	if err != nil {
+		return "", err
+	}
+
+	incident := SPIncident{Name: name, Status: "investigating", Body: body, ComponentIds: rule.ComponentIds}
+	if rule.ComponentStatus != "" {
+		incident.Components = make(map[string]string)
+		for _, id := range rule.ComponentIds {
+			incident.Components[id] = rule.ComponentStatus
+		}
+	}
+
+	parts := []string{config.SPBaseURL, "pages", metric.SPPageId, "incidents.json"}
+	url := strings.Join(parts, "/")
+	var created SPIncident
+	err = spRequest(config, "incidents.", "POST", url, metric.SPPageId, metric.SPApiKey, SPIncidentPayload{Incident: incident}, &created)
+	if err != nil {
+		return "", err
+	}
+	if created.Id == "" {
+		return "", fmt.Errorf("StatusPage didn't return an incident id")
+	}
+	return created.Id, nil
+}
+
+func (d *IncidentDispatcher) resolve(config Config, metric Metric, rule IncidentRule, incidentId string, data IncidentData) error {
+	body, err := rule.render(rule.ResolvedBody, DefaultIncidentResolvedBody, data)
+	if err != nil {
+		return err
+	}
+
+	incident := SPIncident{Status: "resolved", Body: body, ComponentIds: rule.ComponentIds}
+	if rule.ComponentStatus != "" {
+		incident.Components = make(map[string]string)
+		for _, id := range rule.ComponentIds {
+			incident.Components[id] = "operational"
+		}
+	}
+
+	parts := []string{config.SPBaseURL, "pages", metric.SPPageId, "incidents", incidentId + ".json"}
+	url := strings.Join(parts, "/")
+	return spRequest(config, "incidents.", "PATCH", url, metric.SPPageId, metric.SPApiKey, SPIncidentPayload{Incident: incident}, nil)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func MockStatusPageIncidents(requests chan SPIncident) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p SPIncidentPayload
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &p)
+		requests <- p.Incident
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": "inc123"}`))
+	}))
+	return ts
+}
+
+func TestIncidentDispatcher(t *testing.T) {
+	requests := make(chan SPIncident, 10)
+	sp := MockStatusPageIncidents(requests)
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+	d := NewIncidentDispatcher()
+	rule := IncidentRule{
+		Metric:          "error_rate",
+		Threshold:       5,
+		BreachPolls:     2,
+		RecoverPolls:    2,
+		Name:            "Errors at {{.Value}}%",
+		ComponentIds:    []string{"api"},
+		ComponentStatus: "partial_outage",
+	}
+
+	poll := func(value float64) {
+		d.Update(config, Metric{Key: "error_rate", SPPageId: "page", Value: value, Incidents: []IncidentRule{rule}})
+	}
+	expectNothing := func() {
+		if len(requests) != 0 {
+			t.Fatalf("Expected no requests to StatusPage, got: %+v", <-requests)
+		}
+	}
+
+	poll(10)
+	expectNothing()
+	poll(1)
+	poll(10)
+	expectNothing()
+	poll(12)
+	incident := <-requests
+	if incident.Status != "investigating" || incident.Name != "Errors at 12%" || incident.Components["api"] != "partial_outage" {
+		t.Fatalf("Expected an incident to be opened, got: %+v", incident)
+	}
+	poll(15)
+	poll(1)
+	expectNothing()
+	poll(2)
+	incident = <-requests
+	if incident.Status != "resolved" || incident.Components["api"] != "operational" {
+		t.Fatalf("Expected the incident to be resolved, got: %+v", incident)
+	}
+	poll(1)
+	expectNothing()
+}
+
+func TestIncidentDispatcherSharedPage(t *testing.T) {
+	requests := make(chan SPIncident, 10)
+	sp := MockStatusPageIncidents(requests)
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+	d := NewIncidentDispatcher()
+	rule := IncidentRule{Metric: "error_rate", Threshold: 5, BreachPolls: 2, RecoverPolls: 2}
+
+	poll := func(app string, value float64) {
+		d.Update(config, Metric{App: app, Key: "error_rate", SPPageId: "page", Value: value, Incidents: []IncidentRule{rule}})
+	}
+
+	// A healthy app polled in between doesn't reset the other's streak.
+	poll("web", 10)
+	poll("worker", 1)
+	poll("web", 10)
+	incident := <-requests
+	if incident.Status != "investigating" {
+		t.Fatalf("Expected an incident to be opened, got: %+v", incident)
+	}
+
+	// Nor does it resolve an incident it didn't open.
+	poll("worker", 1)
+	poll("worker", 1)
+	if len(requests) != 0 {
+		t.Fatalf("Expected no requests to StatusPage, got: %+v", <-requests)
+	}
+	poll("web", 1)
+	poll("web", 1)
+	incident = <-requests
+	if incident.Status != "resolved" {
+		t.Fatalf("Expected the incident to be resolved, got: %+v", incident)
+	}
+}
+
+func TestIncidentDispatcherRulesOnSameMetric(t *testing.T) {
+	requests := make(chan SPIncident, 10)
+	sp := MockStatusPageIncidents(requests)
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+	d := NewIncidentDispatcher()
+	warning := IncidentRule{Metric: "response_time", Threshold: 100, BreachPolls: 2}
+	critical := IncidentRule{Metric: "response_time", Threshold: 500, BreachPolls: 2}
+
+	// The critical rule recovering every poll doesn't reset the warning
+	// rule's run of breaches.
+	for i := 0; i < 5; i++ {
+		d.Update(config, Metric{App: "web", Key: "response_time", SPPageId: "page", Value: 200, Incidents: []IncidentRule{warning, critical}})
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected the warning rule to open one incident, got %d requests", len(requests))
+	}
+	if incident := <-requests; incident.Status != "investigating" || incident.Name != "Elevated response_time" {
+		t.Fatalf("Expected an incident to be opened, got: %+v", incident)
+	}
+}
+
+func TestAppValidateIncidents(t *testing.T) {
+	app := App{SPPageId: "page", SPMetrics: map[string]MetricConfig{"error_rate": {SPMetricId: "err"}}}
+	app.Incidents = []IncidentRule{{Metric: "error_rate", Threshold: 5, Name: "Errors at {{.Value}}"}}
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected app to be valid, got: %s", err)
+	}
+
+	app.Incidents[0].Name = "Errors at {{.Value"
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for a broken template, got nil")
+	}
+}
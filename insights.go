@@ -0,0 +1,129 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var insightsCounts = expvar.NewMap("insights")
+
+// InsightsResponse is returned by the Insights query API. Only queries that
+// boil down to a single number, like SELECT average(duration) FROM
+// Transaction, can be pushed.
+type InsightsResponse struct {
+	Results  []map[string]interface{} `json:"results"`
+	Metadata InsightsMetadata         `json:"metadata"`
+	Error    string                   `json:"error"`
+}
+
+type InsightsMetadata struct {
+	EndTimeMillis int64 `json:"endTimeMillis"`
+}
+
+// Insights is the Source that runs an NRQL query per metric through the New
+// Relic Insights query API.
+type Insights struct{}
+
+// Validate checks that the app has an account and query key, and that every
+// metric has a query.
+func (Insights) Validate(app App) error {
+	if app.NRAccountId == 0 {
+		return configError("nr_account_id", "missing")
+	}
+	if app.NRQueryKey == "" {
+		return configError("nr_query_key", "missing")
+	}
+	for _, key := range app.MetricKeys() {
+		if app.SPMetrics[key].NRQL == "" {
+			return configError("metrics."+key, "missing nrql")
+		}
+	}
+	return nil
+}
+
+func (Insights) Fetch(config Config, app App) ([]Metric, error) {
+	// Initialise metrics
+	insightsCounts.Add("errors.query", 0)
+	insightsCounts.Add("errors.result", 0)
+
+	var metrics []Metric
+	for _, key := range app.MetricKeys() {
+		value, timestamp, err := queryInsights(config, app, app.SPMetrics[key].NRQL)
+		if err != nil {
+			log.Printf("[error] PollInsights: metric %s: %s\n", key, err)
+			continue
+		}
+		if config.Debug {
+			log.Printf("[debug] PollInsights: %s = %f\n", key, value)
+		}
+		metrics = append(metrics, Metric{
+			Key:        key,
+			SPApiKey:   app.SPApiKey,
+			SPPageId:   app.SPPageId,
+			SPMetricId: app.SPMetrics[key].SPMetricId,
+			Value:      value,
+			Timestamp:  timestamp,
+		})
+	}
+	return metrics, nil
+}
+
+// queryInsights runs an NRQL query, returning its result along with the end of
+// the window it covers.
+func queryInsights(config Config, app App, nrql string) (float64, time.Time, error) {
+	u := config.InsightsBaseURL + strconv.Itoa(app.NRAccountId) + "/query?" + url.Values{"nrql": {nrql}}.Encode()
+
+	var response InsightsResponse
+	status, err := fetchJSON(config, insightsCounts, "PollInsights", u, http.Header{"X-Query-Key": {app.NRQueryKey}}, &response)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if response.Error != "" || status != 200 {
+		insightsCounts.Add("errors.query", 1)
+		return 0, time.Time{}, fmt.Errorf("query failed (HTTP %d): %s", status, response.Error)
+	}
+	if len(response.Results) != 1 {
+		insightsCounts.Add("errors.result", 1)
+		return 0, time.Time{}, fmt.Errorf("expected 1 result, got %d", len(response.Results))
+	}
+
+	value, err := singleValue(response.Results[0])
+	if err != nil {
+		insightsCounts.Add("errors.result", 1)
+		return 0, time.Time{}, err
+	}
+
+	timestamp := time.Now()
+	if response.Metadata.EndTimeMillis != 0 {
+		timestamp = time.Unix(0, response.Metadata.EndTimeMillis*int64(time.Millisecond))
+	}
+	return value, timestamp, nil
+}
+
+// singleValue digs the only number out of a query result, e.g. {"average":
+// 1.2} or {"percentiles": {"95": 1.2}}.
+func singleValue(result interface{}) (float64, error) {
+	switch v := result.(type) {
+	case float64:
+		return v, nil
+	case map[string]interface{}:
+		if len(v) != 1 {
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			return 0, fmt.Errorf("expected a single value, got %v", keys)
+		}
+		for _, value := range v {
+			return singleValue(value)
+		}
+	}
+	return 0, fmt.Errorf("expected a number, got %v", result)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func MockInsights(results map[string]string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Query-Key") != "querykey" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "Invalid query key"}`))
+			return
+		}
+		result, ok := results[r.URL.Query().Get("nrql")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "NRQL Syntax Error"}`))
+			return
+		}
+		w.Write([]byte(result))
+	}))
+	return ts
+}
+
+func TestInsightsQuery(t *testing.T) {
+	insights := MockInsights(map[string]string{
+		"SELECT average(duration) FROM Transaction":            `{"results": [{"average": 0.42}]}`,
+		"SELECT percentile(duration, 95) FROM Transaction":     `{"results": [{"percentiles": {"95": 1.5}}]}`,
+		"SELECT min(duration), max(duration) FROM Transaction": `{"results": [{"min": 0.1}, {"max": 9}]}`,
+	})
+	defer insights.Close()
+
+	config := Config{
+		InsightsBaseURL: insights.URL + "/v1/accounts/",
+	}
+	app := App{
+		Source:      "insights",
+		NRAccountId: 1234,
+		NRQueryKey:  "querykey",
+		SPPageId:    "page",
+		SPMetrics: map[string]MetricConfig{
+			"average":    {SPMetricId: "avg", NRQL: "SELECT average(duration) FROM Transaction"},
+			"percentile": {SPMetricId: "p95", NRQL: "SELECT percentile(duration, 95) FROM Transaction"},
+			"minmax":     {SPMetricId: "minmax", NRQL: "SELECT min(duration), max(duration) FROM Transaction"},
+			"broken":     {SPMetricId: "broken", NRQL: "SELECT"},
+		},
+	}
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected app to be valid, got: %s", err)
+	}
+
+	metrics, err := Insights{}.Fetch(config, app)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	expected := map[string]float64{"avg": 0.42, "p95": 1.5}
+	if len(metrics) != len(expected) {
+		t.Fatalf("Expected %d metrics, got: %+v", len(expected), metrics)
+	}
+	for _, m := range metrics {
+		if m.Value != expected[m.SPMetricId] {
+			t.Fatalf("Expected %s to be %f, got %f", m.SPMetricId, expected[m.SPMetricId], m.Value)
+		}
+	}
+
+	app.NRQueryKey = "wrong"
+	metrics, _ = Insights{}.Fetch(config, app)
+	if len(metrics) != 0 {
+		t.Fatalf("Expected no metrics with a bad query key, got: %+v", metrics)
+	}
+}
+
+func TestInsightsValidate(t *testing.T) {
+	app := App{Source: "insights", NRQueryKey: "querykey", SPPageId: "page"}
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for a missing nr_account_id, got nil")
+	}
+}
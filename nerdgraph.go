@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var nerdgraphCounts = expvar.NewMap("nerdgraph")
+
+const goldenMetricsQuery = `query($guid: EntityGuid!) {
+  actor { entity(guid: $guid) { goldenMetrics { metrics { name query } } } }
+}`
+
+const nrqlQuery = `query($accountId: Int!, $nrql: Nrql!) {
+  actor { account(id: $accountId) { nrql(query: $nrql) { results metadata { timeWindow { end } } } } }
+}`
+
+// GraphQLRequest is the body POSTed to NerdGraph.
+type GraphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// GraphQLResponse is NerdGraph's reply. Data is decoded separately, as its
+// shape depends on the query.
+type GraphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []GraphQLError  `json:"errors"`
+}
+
+type GraphQLError struct {
+	Message string `json:"message"`
+}
+
+type GoldenMetricsData struct {
+	Actor struct {
+		Entity *struct {
+			GoldenMetrics struct {
+				Metrics []GoldenMetric `json:"metrics"`
+			} `json:"goldenMetrics"`
+		} `json:"entity"`
+	} `json:"actor"`
+}
+
+type GoldenMetric struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+type NRQLData struct {
+	Actor struct {
+		Account struct {
+			NRQL struct {
+				Results  []map[string]interface{} `json:"results"`
+				Metadata struct {
+					TimeWindow struct {
+						// End is in milliseconds since the epoch.
+						End int64 `json:"end"`
+					} `json:"timeWindow"`
+				} `json:"metadata"`
+			} `json:"nrql"`
+		} `json:"account"`
+	} `json:"actor"`
+}
+
+// timeseries matches the clause golden metric queries use to draw charts,
+// which would otherwise turn their single number into a series.
+var timeseries = regexp.MustCompile(`(?i)\s+TIMESERIES(\s+(AUTO|MAX|\d+\s+\w+))?`)
+
+// NerdGraph is the Source that fetches entity golden metrics, or runs NRQL,
+// through New Relic's GraphQL API. It authenticates with a user API key.
+type NerdGraph struct{}
+
+// EntityGuid returns the app's entity guid, working it out from the account
+// and application ids for apps configured with nr_app_id.
+func (app App) EntityGuid() string {
+	if app.NREntityGuid != "" {
+		return app.NREntityGuid
+	}
+	if app.NRAccountId == 0 || app.NRAppId == 0 {
+		return ""
+	}
+	id := fmt.Sprintf("%d|APM|APPLICATION|%d", app.NRAccountId, app.NRAppId)
+	return base64.RawStdEncoding.EncodeToString([]byte(id))
+}
+
+// Validate checks that the app has a user key and account, and that every
+// metric is either a golden metric of a known entity or an NRQL query.
+func (NerdGraph) Validate(app App) error {
+	if app.NRApiKey == "" {
+		return configError("nr_api_key", "missing")
+	}
+	if app.NRAccountId == 0 {
+		return configError("nr_account_id", "missing")
+	}
+	for _, key := range app.MetricKeys() {
+		m := app.SPMetrics[key]
+		switch {
+		case m.GoldenMetric != "" && m.NRQL != "":
+			return configError("metrics."+key, "has both golden_metric and nrql")
+		case m.GoldenMetric != "" && app.EntityGuid() == "":
+			return configError("metrics."+key, "golden_metric needs nr_entity_guid or nr_app_id")
+		case m.GoldenMetric == "" && m.NRQL == "":
+			return configError("metrics."+key, "missing golden_metric or nrql")
+		}
+	}
+	return nil
+}
+
+func (NerdGraph) Fetch(config Config, app App) ([]Metric, error) {
+	// Initialise metrics
+	nerdgraphCounts.Add("errors.graphql", 0)
+	nerdgraphCounts.Add("errors.result", 0)
+
+	var golden map[string]string
+	for _, m := range app.SPMetrics {
+		if m.GoldenMetric == "" {
+			continue
+		}
+		var err error
+		golden, err = goldenMetrics(config, app)
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	var metrics []Metric
+	for _, key := range app.MetricKeys() {
+		nrql := app.SPMetrics[key].NRQL
+		if name := app.SPMetrics[key].GoldenMetric; name != "" {
+			query, ok := golden[name]
+			if !ok {
+				log.Printf("[error] PollNerdGraph: metric %s: entity has no golden metric %q\n", key, name)
+				nerdgraphCounts.Add("errors.result", 1)
+				continue
+			}
+			nrql = timeseries.ReplaceAllString(query, "")
+		}
+
+		value, timestamp, err := queryNerdGraphNRQL(config, app, nrql)
+		if err != nil {
+			log.Printf("[error] PollNerdGraph: metric %s: %s\n", key, err)
+			continue
+		}
+		if config.Debug {
+			log.Printf("[debug] PollNerdGraph: %s = %f\n", key, value)
+		}
+		metrics = append(metrics, Metric{
+			Key:        key,
+			SPApiKey:   app.SPApiKey,
+			SPPageId:   app.SPPageId,
+			SPMetricId: app.SPMetrics[key].SPMetricId,
+			Value:      value,
+			Timestamp:  timestamp,
+		})
+	}
+	return metrics, nil
+}
+
+// queryNerdGraph runs a GraphQL query and decodes its data into v.
+func queryNerdGraph(config Config, app App, query string, variables map[string]interface{}, v interface{}) error {
+	request := GraphQLRequest{Query: query, Variables: variables}
+	header := http.Header{"Api-Key": {app.NRApiKey}}
+
+	var response GraphQLResponse
+	status, err := postJSON(config, nerdgraphCounts, "PollNerdGraph", config.NerdGraphURL, header, request, &response)
+	if err != nil {
+		return err
+	}
+	if len(response.Errors) > 0 || status != 200 {
+		nerdgraphCounts.Add("errors.graphql", 1)
+		messages := make([]string, 0, len(response.Errors))
+		for _, e := range response.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("query failed (HTTP %d): %s", status, strings.Join(messages, "; "))
+	}
+	if err := json.Unmarshal(response.Data, v); err != nil {
+		nerdgraphCounts.Add("errors.json.decode", 1)
+		return fmt.Errorf("couldn't decode data: %s, raw data: %s", err, response.Data)
+	}
+	return nil
+}
+
+// goldenMetrics returns the NRQL behind each of the app entity's golden
+// metrics, by name.
+func goldenMetrics(config Config, app App) (map[string]string, error) {
+	var data GoldenMetricsData
+	err := queryNerdGraph(config, app, goldenMetricsQuery, map[string]interface{}{"guid": app.EntityGuid()}, &data)
+	if err != nil {
+		return nil, err
+	}
+	if data.Actor.Entity == nil {
+		nerdgraphCounts.Add("errors.result", 1)
+		return nil, fmt.Errorf("no entity with guid %s", app.EntityGuid())
+	}
+
+	queries := make(map[string]string)
+	for _, m := range data.Actor.Entity.GoldenMetrics.Metrics {
+		queries[m.Name] = m.Query
+	}
+	return queries, nil
+}
+
+// queryNerdGraphNRQL runs an NRQL query, returning its result along with the
+// end of the window it covers.
+func queryNerdGraphNRQL(config Config, app App, nrql string) (float64, time.Time, error) {
+	var data NRQLData
+	variables := map[string]interface{}{"accountId": app.NRAccountId, "nrql": nrql}
+	if err := queryNerdGraph(config, app, nrqlQuery, variables, &data); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	results := data.Actor.Account.NRQL.Results
+	if len(results) != 1 {
+		nerdgraphCounts.Add("errors.result", 1)
+		return 0, time.Time{}, fmt.Errorf("expected 1 result, got %d", len(results))
+	}
+	value, err := singleValue(results[0])
+	if err != nil {
+		nerdgraphCounts.Add("errors.result", 1)
+		return 0, time.Time{}, err
+	}
+
+	timestamp := time.Now()
+	if end := data.Actor.Account.NRQL.Metadata.TimeWindow.End; end != 0 {
+		timestamp = time.Unix(0, end*int64(time.Millisecond))
+	}
+	return value, timestamp, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// MockNerdGraph answers golden metric lookups for guid, and NRQL queries from
+// results.
+func MockNerdGraph(guid string, golden map[string]string, results map[string]string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Api-Key") != "userkey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors": [{"message": "Invalid API key"}]}`))
+			return
+		}
+		var req GraphQLRequest
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &req)
+
+		switch {
+		case strings.Contains(req.Query, "goldenMetrics"):
+			if req.Variables["guid"] != guid {
+				w.Write([]byte(`{"data": {"actor": {"entity": null}}}`))
+				return
+			}
+			var metrics []GoldenMetric
+			for name, query := range golden {
+				metrics = append(metrics, GoldenMetric{Name: name, Query: query})
+			}
+			b, _ := json.Marshal(metrics)
+			w.Write([]byte(`{"data": {"actor": {"entity": {"goldenMetrics": {"metrics": ` + string(b) + `}}}}}`))
+		case strings.Contains(req.Query, "nrql"):
+			result, ok := results[req.Variables["nrql"].(string)]
+			if !ok {
+				w.Write([]byte(`{"data": {"actor": {"account": {"nrql": null}}}, "errors": [{"message": "NRQL Syntax Error"}]}`))
+				return
+			}
+			w.Write([]byte(`{"data": {"actor": {"account": {"nrql": {"results": ` + result + `}}}}}`))
+		}
+	}))
+	return ts
+}
+
+func TestNerdGraphFetch(t *testing.T) {
+	guid := base64.RawStdEncoding.EncodeToString([]byte("1234|APM|APPLICATION|123456"))
+	ng := MockNerdGraph(guid,
+		map[string]string{"responseTimeMs": "SELECT average(duration) * 1000 FROM Transaction WHERE entityGuid = 'x' TIMESERIES"},
+		map[string]string{
+			"SELECT average(duration) * 1000 FROM Transaction WHERE entityGuid = 'x'": `[{"average": 215.5}]`,
+			"SELECT count(*) FROM TransactionError":                                   `[{"count": 3}]`,
+		})
+	defer ng.Close()
+
+	config := Config{
+		NerdGraphURL: ng.URL + "/graphql",
+	}
+	app := App{
+		Source:      "nerdgraph",
+		NRApiKey:    "userkey",
+		NRAccountId: 1234,
+		NRAppId:     123456,
+		SPPageId:    "page",
+		SPMetrics: map[string]MetricConfig{
+			"response_time": {SPMetricId: "rt", GoldenMetric: "responseTimeMs"},
+			"errors":        {SPMetricId: "errors", NRQL: "SELECT count(*) FROM TransactionError"},
+			"missing":       {SPMetricId: "missing", GoldenMetric: "throughput"},
+		},
+	}
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected app to be valid, got: %s", err)
+	}
+
+	metrics, err := NerdGraph{}.Fetch(config, app)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	expected := map[string]float64{"rt": 215.5, "errors": 3}
+	if len(metrics) != len(expected) {
+		t.Fatalf("Expected %d metrics, got: %+v", len(expected), metrics)
+	}
+	for _, m := range metrics {
+		if m.Value != expected[m.SPMetricId] {
+			t.Fatalf("Expected %s to be %f, got %f", m.SPMetricId, expected[m.SPMetricId], m.Value)
+		}
+	}
+
+	app.NRApiKey = "wrong"
+	if _, err := (NerdGraph{}).Fetch(config, app); err == nil {
+		t.Fatal("Expected an error with a bad user key, got nil")
+	}
+}
+
+func TestNerdGraphValidate(t *testing.T) {
+	app := App{
+		Source:      "nerdgraph",
+		NRApiKey:    "userkey",
+		NRAccountId: 1234,
+		SPPageId:    "page",
+		SPMetrics:   map[string]MetricConfig{"response_time": {SPMetricId: "rt", GoldenMetric: "responseTimeMs"}},
+	}
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for a golden metric without an entity, got nil")
+	}
+
+	app.NREntityGuid = "MTIzNHxBUE18QVBQTElDQVRJT058MTIzNDU2"
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected app to be valid, got: %s", err)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var newrelicCounts = expvar.NewMap("newrelic")
+
+type ApplicationResponse struct {
+	Application Application
+}
+
+type Application struct {
+	Id                 int                `json:"id"`
+	Name               string             `json:"name"`
+	Reporting          bool               `json:"reporting"`
+	LastReportedAt     time.Time          `json:"last_reported_at"`
+	ApplicationSummary ApplicationSummary `json:"application_summary"`
+}
+
+type ApplicationSummary struct {
+	ResponseTime  float64 `json:"response_time"`
+	Throughput    float64 `json:"throughput"`
+	ErrorRate     float64 `json:"error_rate"`
+	ApdexTarget   float64 `json:"apdex_target"`
+	ApdexScore    float64 `json:"apdex_score"`
+	HostCount     float64 `json:"host_count"`
+	InstanceCount float64 `json:"instance_count"`
+}
+
+// SummaryFields maps the keys accepted in an app's "metrics" config to the
+// ApplicationSummary field that is pushed to StatusPage for that key.
+var SummaryFields = map[string]func(ApplicationSummary) float64{
+	"response_time":  func(s ApplicationSummary) float64 { return s.ResponseTime },
+	"throughput":     func(s ApplicationSummary) float64 { return s.Throughput },
+	"error_rate":     func(s ApplicationSummary) float64 { return s.ErrorRate },
+	"apdex_target":   func(s ApplicationSummary) float64 { return s.ApdexTarget },
+	"apdex_score":    func(s ApplicationSummary) float64 { return s.ApdexScore },
+	"host_count":     func(s ApplicationSummary) float64 { return s.HostCount },
+	"instance_count": func(s ApplicationSummary) float64 { return s.InstanceCount },
+}
+
+// MetricDataResponse is returned by the metric data endpoint,
+// /v2/applications/{id}/metrics/data.json.
+type MetricDataResponse struct {
+	MetricData MetricData `json:"metric_data"`
+}
+
+type MetricData struct {
+	From            time.Time        `json:"from"`
+	To              time.Time        `json:"to"`
+	MetricsNotFound []string         `json:"metrics_not_found"`
+	MetricsFound    []string         `json:"metrics_found"`
+	Metrics         []MetricDataItem `json:"metrics"`
+}
+
+type MetricDataItem struct {
+	Name       string      `json:"name"`
+	Timeslices []Timeslice `json:"timeslices"`
+}
+
+type Timeslice struct {
+	From   time.Time          `json:"from"`
+	To     time.Time          `json:"to"`
+	Values map[string]float64 `json:"values"`
+}
+
+// NRErrorResponse is the body New Relic sends along with an error status.
+type NRErrorResponse struct {
+	Error struct {
+		Title string `json:"title"`
+	} `json:"error"`
+}
+
+// Classes of NewRelicError.
+const (
+	NRAuthError        = "auth"
+	NRNotFoundError    = "not_found"
+	NRRateLimitedError = "rate_limited"
+	NRServerError      = "server"
+	NRStatusError      = "status"
+)
+
+// NewRelicError is returned when New Relic responds with anything but a 200,
+// classed by what went wrong.
+type NewRelicError struct {
+	Class      string
+	StatusCode int
+	// Title is the error's title from the body, if New Relic sent one.
+	Title string
+}
+
+func NewNewRelicError(status int, body []byte) *NewRelicError {
+	var response NRErrorResponse
+	_ = json.Unmarshal(body, &response)
+
+	e := &NewRelicError{Class: NRStatusError, StatusCode: status, Title: response.Error.Title}
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.Class = NRAuthError
+	case status == http.StatusNotFound:
+		e.Class = NRNotFoundError
+	case status == http.StatusTooManyRequests:
+		e.Class = NRRateLimitedError
+	case status >= 500:
+		e.Class = NRServerError
+	}
+	return e
+}
+
+func (e *NewRelicError) Error() string {
+	descriptions := map[string]string{
+		NRAuthError:        "authentication failed",
+		NRNotFoundError:    "not found",
+		NRRateLimitedError: "rate limited",
+		NRServerError:      "server error",
+		NRStatusError:      "unexpected status",
+	}
+	msg := fmt.Sprintf("New Relic: %s (HTTP %d)", descriptions[e.Class], e.StatusCode)
+	if e.Title != "" {
+		msg += ": " + e.Title
+	}
+	return msg
+}
+
+// fetchNR GETs url from the New Relic REST API and decodes the response into
+// v, or returns a NewRelicError if New Relic didn't respond with a 200.
+func fetchNR(config Config, url string, apiKey string, v interface{}) error {
+	// Initialise metrics
+	for _, class := range []string{NRAuthError, NRNotFoundError, NRRateLimitedError, NRServerError, NRStatusError} {
+		newrelicCounts.Add("errors.status."+class, 0)
+	}
+
+	var raw json.RawMessage
+	status, err := fetchJSON(config, newrelicCounts, "PollNR", url, http.Header{"X-Api-Key": {apiKey}}, &raw)
+	if err == nil && status != http.StatusOK {
+		e := NewNewRelicError(status, raw)
+		newrelicCounts.Add("errors.status."+e.Class, 1)
+		return e
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		newrelicCounts.Add("errors.json.decode", 1)
+		return fmt.Errorf("couldn't decode json: %s, raw body: %s", err, raw)
+	}
+	return nil
+}
+
+// NewRelic is the Source that reads an application's summary, or named
+// metric data, from the New Relic REST API (v2).
+type NewRelic struct{}
+
+// Validate checks that every metric the app asks for is either a known summary
+// field, or names a New Relic metric and value.
+func (NewRelic) Validate(app App) error {
+	for _, key := range app.MetricKeys() {
+		m := app.SPMetrics[key]
+		if m.MetricName != "" || m.MetricValue != "" {
+			if m.MetricName == "" || m.MetricValue == "" {
+				return configError("metrics."+key, "needs both name and value")
+			}
+			if err := m.validateWindow(); err != nil {
+				return configError("metrics."+key, "%s", err)
+			}
+			continue
+		}
+		if _, ok := SummaryFields[key]; !ok {
+			return configError("metrics."+key, "unknown metric %q", key)
+		}
+	}
+	return nil
+}
+
+// validateWindow checks that from and to, if set, are durations.
+func (m MetricConfig) validateWindow() error {
+	for _, d := range []string{m.From, m.To} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (NewRelic) Fetch(config Config, app App) ([]Metric, error) {
+	// Initialise metrics
+	for key := range SummaryFields {
+		newrelicCounts.Add("apps."+key, 0)
+	}
+	newrelicCounts.Add("apps.metric_data", 0)
+	newrelicCounts.Add("errors.metric_data", 0)
+
+	appid := strconv.Itoa(app.NRAppId)
+
+	// The summary is only skipped when every metric comes from metric data.
+	summary := len(app.SPMetrics) == 0
+	for _, m := range app.SPMetrics {
+		if m.MetricName == "" {
+			summary = true
+		}
+	}
+
+	var sample ApplicationResponse
+	observed := time.Now()
+	if summary {
+		parts := []string{config.NRBaseURL, appid, ".json"}
+		url := strings.Join(parts, "")
+		err := fetchNR(config, url, app.NRApiKey, &sample)
+		if err != nil {
+			return nil, err
+		}
+		observed = time.Now()
+		if !sample.Application.LastReportedAt.IsZero() {
+			observed = sample.Application.LastReportedAt
+		}
+	}
+
+	var metrics []Metric
+	for _, key := range app.MetricKeys() {
+		m := Metric{Key: key, SPPageId: app.SPPageId, SPApiKey: app.SPApiKey}
+		m.SPMetricId = app.SPMetrics[key].SPMetricId
+
+		if app.SPMetrics[key].MetricName != "" {
+			value, timestamp, err := fetchMetricData(config, app, app.SPMetrics[key])
+			if err != nil {
+				log.Printf("[error] PollNR: metric %s for nr_app_id %s: %s\n", key, appid, err)
+				newrelicCounts.Add("errors.metric_data", 1)
+				continue
+			}
+			newrelicCounts.Add("apps.metric_data", 1)
+			m.Value = value
+			m.Timestamp = timestamp
+			metrics = append(metrics, m)
+			continue
+		}
+
+		field, ok := SummaryFields[key]
+		if !ok {
+			log.Printf("[error] PollNR: unknown metric %s for nr_app_id %s\n", key, appid)
+			continue
+		}
+		if config.Debug {
+			log.Printf("[debug] PollNR: Fetching %s for nr_app_id %s\n", key, appid)
+		}
+		newrelicCounts.Add("apps."+key, 1)
+		m.Value = field(sample.Application.ApplicationSummary)
+		m.Timestamp = observed
+		m.notReporting = !sample.Application.Reporting
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// fetchMetricData reads a single value of a named metric from the metric data
+// endpoint, along with the end of the timeslice it covers. When the window
+// covers more than one timeslice, the latest wins.
+func fetchMetricData(config Config, app App, metric MetricConfig) (float64, time.Time, error) {
+	params := url.Values{
+		"names[]":  {metric.MetricName},
+		"values[]": {metric.MetricValue},
+	}
+	now := time.Now().UTC()
+	if metric.From != "" {
+		d, _ := time.ParseDuration(metric.From)
+		params.Set("from", now.Add(-d).Format(time.RFC3339))
+	}
+	if metric.To != "" {
+		d, _ := time.ParseDuration(metric.To)
+		params.Set("to", now.Add(-d).Format(time.RFC3339))
+	}
+	if metric.Summarize {
+		params.Set("summarize", "true")
+	}
+	u := config.NRBaseURL + strconv.Itoa(app.NRAppId) + "/metrics/data.json?" + params.Encode()
+
+	var data MetricDataResponse
+	err := fetchNR(config, u, app.NRApiKey, &data)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	for _, item := range data.MetricData.Metrics {
+		if item.Name != metric.MetricName || len(item.Timeslices) == 0 {
+			continue
+		}
+		slice := item.Timeslices[len(item.Timeslices)-1]
+		value, ok := slice.Values[metric.MetricValue]
+		if !ok {
+			return 0, time.Time{}, fmt.Errorf("metric %s has no value %s", metric.MetricName, metric.MetricValue)
+		}
+		return value, slice.To, nil
+	}
+	return 0, time.Time{}, fmt.Errorf("metric %s not found", metric.MetricName)
+}
+
+// PollNR fetches an app's summary from New Relic and sends its metrics on.
+// Nothing is sent if New Relic responds with an error.
+func PollNR(config Config, app App, metrics chan Metric) {
+	PollSource(config, NewRelic{}, app, metrics)
+}
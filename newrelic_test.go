@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRelicSummaryFields(t *testing.T) {
+	nr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := ApplicationResponse{}
+		response.Application.ApplicationSummary.ApdexScore = 0.93
+		response.Application.ApplicationSummary.HostCount = 4
+		b, _ := json.Marshal(response)
+		w.Write(b)
+	}))
+	defer nr.Close()
+
+	config := Config{
+		NRBaseURL: nr.URL + "/v2/applications/",
+	}
+	metrics := make(chan Metric)
+	app := App{NRAppId: 123456, SPMetrics: map[string]MetricConfig{"apdex_score": {SPMetricId: "apdex"}, "host_count": {SPMetricId: "hosts"}}}
+	go PollNR(config, app, metrics)
+
+	expected := map[string]float64{"apdex": 0.93, "hosts": 4}
+	for i := 0; i < len(expected); i++ {
+		select {
+		case m := <-metrics:
+			if m.Value != expected[m.SPMetricId] {
+				t.Fatalf("Expected %s to be %f, got %f", m.SPMetricId, expected[m.SPMetricId], m.Value)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("Expected metrics from New Relic, got nothing after 1 second.")
+		}
+	}
+}
+
+func TestAppValidateUnknownMetric(t *testing.T) {
+	app := App{NRAppId: 123456, SPPageId: "page", SPMetrics: map[string]MetricConfig{"apdex_score": {SPMetricId: "apdex"}}}
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected apdex_score to be valid, got: %s", err)
+	}
+
+	app.SPMetrics["apdex"] = MetricConfig{SPMetricId: "apdex"}
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for unknown metric 'apdex', got nil")
+	}
+}
+
+func TestNewRelicMetricData(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	nr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/123456/metrics/data.json") {
+			t.Errorf("Expected a request for metric data, got: %s", r.URL.Path)
+		}
+		queries <- r.URL.Query()
+		w.Write([]byte(`{"metric_data": {"metrics_found": ["Datastore/all"], "metrics": [{"name": "Datastore/all", "timeslices": [
+			{"from": "2016-01-01T00:00:00+00:00", "to": "2016-01-01T00:01:00+00:00", "values": {"average_response_time": 3.5}},
+			{"from": "2016-01-01T00:01:00+00:00", "to": "2016-01-01T00:02:00+00:00", "values": {"average_response_time": 4.5}}
+		]}]}}`))
+	}))
+	defer nr.Close()
+
+	config := Config{
+		NRBaseURL: nr.URL + "/v2/applications/",
+	}
+	app := App{NRAppId: 123456, SPPageId: "page", SPMetrics: map[string]MetricConfig{
+		"db": {SPMetricId: "db", MetricName: "Datastore/all", MetricValue: "average_response_time", From: "30m"},
+	}}
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected app to be valid, got: %s", err)
+	}
+
+	metrics, err := NewRelic{}.Fetch(config, app)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+	if len(metrics) != 1 || metrics[0].Value != 4.5 {
+		t.Fatalf("Expected the latest timeslice's value 4.5, got: %+v", metrics)
+	}
+	if to := time.Date(2016, 1, 1, 0, 2, 0, 0, time.UTC); !metrics[0].Timestamp.Equal(to) {
+		t.Fatalf("Expected the metric to be timestamped with the end of the timeslice %s, got %s", to, metrics[0].Timestamp)
+	}
+
+	query := <-queries
+	if query.Get("names[]") != "Datastore/all" || query.Get("values[]") != "average_response_time" || query.Get("from") == "" {
+		t.Fatalf("Expected names[], values[] and from in the query, got: %s", query.Encode())
+	}
+}
+
+func TestNewRelicMetricDataValidate(t *testing.T) {
+	app := App{NRAppId: 123456, SPPageId: "page", SPMetrics: map[string]MetricConfig{
+		"db": {SPMetricId: "db", MetricName: "Datastore/all"},
+	}}
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for a metric name without a value, got nil")
+	}
+
+	app.SPMetrics["db"] = MetricConfig{SPMetricId: "db", MetricName: "Datastore/all", MetricValue: "call_count", From: "yesterday"}
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for a malformed from, got nil")
+	}
+}
+
+func TestNewRelicErrorResponses(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		class  string
+		title  string
+	}{
+		{401, `{"error": {"title": "The API key provided is invalid"}}`, NRAuthError, "The API key provided is invalid"},
+		{403, `{"error": {"title": "Access to this resource is forbidden"}}`, NRAuthError, "Access to this resource is forbidden"},
+		{404, `{"error": {"title": "Application not found"}}`, NRNotFoundError, "Application not found"},
+		{429, `{"error": {"title": "Rate limit exceeded"}}`, NRRateLimitedError, "Rate limit exceeded"},
+		{500, `{"error": {"title": "Internal server error"}}`, NRServerError, "Internal server error"},
+		{503, `{"error": {"title": "Service unavailable"}}`, NRServerError, "Service unavailable"},
+		{502, `<html><body>Bad Gateway</body></html>`, NRServerError, ""},
+		{400, `{"error": {"title": "Invalid parameter"}}`, NRStatusError, "Invalid parameter"},
+	}
+
+	for _, test := range tests {
+		nr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+
+		config := Config{
+			NRBaseURL: nr.URL + "/v2/applications/",
+		}
+		app := App{NRAppId: 123456, SPPageId: "page", SPMetrics: map[string]MetricConfig{"apdex_score": {SPMetricId: "apdex"}}}
+		before := counterValue(newrelicCounts, "errors.status."+test.class)
+		decode := counterValue(newrelicCounts, "errors.json.decode")
+
+		_, err := NewRelic{}.Fetch(config, app)
+		e, ok := err.(*NewRelicError)
+		if !ok {
+			t.Fatalf("HTTP %d: expected a *NewRelicError, got: %#v", test.status, err)
+		}
+		if e.Class != test.class || e.StatusCode != test.status || e.Title != test.title {
+			t.Fatalf("HTTP %d: expected class %q and title %q, got: %+v", test.status, test.class, test.title, e)
+		}
+		if after := counterValue(newrelicCounts, "errors.status."+test.class); after != before+1 {
+			t.Fatalf("HTTP %d: expected errors.status.%s to go from %d to %d, got %d", test.status, test.class, before, before+1, after)
+		}
+		if after := counterValue(newrelicCounts, "errors.json.decode"); after != decode {
+			t.Fatalf("HTTP %d: expected errors.json.decode to stay at %d, got %d", test.status, decode, after)
+		}
+
+		metrics := make(chan Metric, 10)
+		PollNR(config, app, metrics)
+		if len(metrics) != 0 {
+			t.Fatalf("HTTP %d: expected no metrics, got %d", test.status, len(metrics))
+		}
+		nr.Close()
+	}
+}
+
+func TestNewRelicMetricDataError(t *testing.T) {
+	nr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/metrics/data.json") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"title": "Metric not found"}}`))
+			return
+		}
+		w.Write([]byte(`{"application": {"application_summary": {"apdex_score": 0.9}}}`))
+	}))
+	defer nr.Close()
+
+	config := Config{
+		NRBaseURL: nr.URL + "/v2/applications/",
+	}
+	app := App{NRAppId: 123456, SPPageId: "page", SPMetrics: map[string]MetricConfig{
+		"db": {SPMetricId: "db", MetricName: "Datastore/all", MetricValue: "average_response_time"},
+	}}
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected app to be valid, got: %s", err)
+	}
+
+	before := counterValue(newrelicCounts, "errors.status."+NRNotFoundError)
+	metrics, err := NewRelic{}.Fetch(config, app)
+	if err != nil {
+		t.Fatalf("Expected failed metric data to be skipped, got: %s", err)
+	}
+	if len(metrics) != 0 {
+		t.Fatalf("Expected no metrics, got: %+v", metrics)
+	}
+	if after := counterValue(newrelicCounts, "errors.status."+NRNotFoundError); after != before+1 {
+		t.Fatalf("Expected errors.status.not_found to go from %d to %d, got %d", before, before+1, after)
+	}
+}
+
+func counterValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -1,165 +1,172 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"expvar"
+	"fmt"
 	"gopkg.in/alecthomas/kingpin.v1"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 )
 
-var (
-	newrelicCounts   = expvar.NewMap("newrelic")
-	statuspageCounts = expvar.NewMap("statuspage")
-)
-
 type Config struct {
-	Timeout    time.Duration
-	Interval   time.Duration
-	ConfigPath string
-	Debug      bool
-	SPBaseURL  string
-	NRBaseURL  string
-	Port       string
+	Timeout         time.Duration
+	BatchWindow     time.Duration
+	Retries         int
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	Interval        time.Duration
+	ConfigPath      string
+	Debug           bool
+	DryRun          bool
+	DryRunFormat    string
+	SPBaseURL       string
+	NRBaseURL       string
+	InsightsBaseURL string
+	NerdGraphURL    string
+	Port            string
+	ShutdownTimeout time.Duration
+	ReadyWindow     time.Duration
+	RateLimit       float64
+	RateBurst       int
+	Workers         int
+
+	// QueueDir, if set, is where metrics wait to be dispatched.
+	QueueDir     string
+	QueueMaxSize int
+	QueueMaxAge  time.Duration
+
+	// Client is shared by requests to sinks, so connections are reused.
+	Client *http.Client
+	// Output is where dry runs print what would have been sent; stdout if
+	// nil.
+	Output io.Writer
+
+	// pool is set for jobs running in Dispatch's Pool, which give up their
+	// worker while they sleep.
+	pool *Pool
+}
+
+// sleep waits for d, letting another job have the worker meanwhile if
+// called from a job in Dispatch's Pool.
+func (config Config) sleep(d time.Duration) {
+	if config.pool != nil {
+		config.pool.Sleep(d)
+		return
+	}
+	time.Sleep(d)
 }
 
-type ApplicationResponse struct {
-	Application Application
+// HTTPClient returns the client sinks should send requests with.
+func (config Config) HTTPClient() *http.Client {
+	if config.Client != nil {
+		return config.Client
+	}
+	return &http.Client{Timeout: config.Timeout}
 }
 
-type Application struct {
-	Id                 int                `json:"id"`
-	Name               string             `json:"name"`
-	Reporting          bool               `json:"reporting"`
-	ApplicationSummary ApplicationSummary `json:"application_summary"`
+type App struct {
+	Source        string                  `json:"source"`
+	NRApiKey      string                  `json:"nr_api_key"`
+	NRAppId       int                     `json:"nr_app_id"`
+	NRAccountId   int                     `json:"nr_account_id"`
+	NRQueryKey    string                  `json:"nr_query_key"`
+	NREntityGuid  string                  `json:"nr_entity_guid"`
+	PrometheusURL string                  `json:"prometheus_url"`
+	URL           string                  `json:"url"`
+	Headers       map[string]string       `json:"headers"`
+	SPApiKey      string                  `json:"sp_api_key"`
+	SPPageId      string                  `json:"sp_page_id"`
+	SPMetrics     map[string]MetricConfig `json:"metrics"`
+	Sinks         []SinkConfig            `json:"sinks"`
+	Components    []ComponentRule         `json:"components"`
+	Incidents     []IncidentRule          `json:"incidents"`
+	Staleness     StalenessConfig         `json:"staleness"`
 }
 
-type ApplicationSummary struct {
-	ResponseTime  float64 `json:"response_time"`
-	Throughput    float64 `json:"throughput"`
-	ErrorRate     float64 `json:"error_rate"`
-	ApdexTarget   float64 `json:"apdex_target"`
-	ApdexScore    float64 `json:"apdex_score"`
-	HostCount     float64 `json:"host_count"`
-	InstanceCount float64 `json:"instance_count"`
+// MetricConfig is an entry in an app's "metrics" config. It is usually just
+// the StatusPage metric id, but sources that need to know more about how to
+// fetch a metric accept an object instead.
+type MetricConfig struct {
+	SPMetricId   string `json:"sp_metric_id"`
+	Query        string `json:"query"`
+	Path         string `json:"path"`
+	NRQL         string `json:"nrql"`
+	GoldenMetric string `json:"golden_metric"`
+
+	// For New Relic metric data, rather than the application summary.
+	MetricName  string `json:"name"`
+	MetricValue string `json:"value"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Summarize   bool   `json:"summarize"`
 }
 
-type App struct {
-	NRApiKey  string            `json:"nr_api_key"`
-	NRAppId   int               `json:"nr_app_id"`
-	SPApiKey  string            `json:"sp_api_key"`
-	SPPageId  string            `json:"sp_page_id"`
-	SPMetrics map[string]string `json:"metrics"`
+func (m *MetricConfig) UnmarshalJSON(b []byte) error {
+	var id string
+	if err := json.Unmarshal(b, &id); err == nil {
+		*m = MetricConfig{SPMetricId: id}
+		return nil
+	}
+	type plain MetricConfig
+	return json.Unmarshal(b, (*plain)(m))
+}
+
+// MetricKeys returns the keys of the app's "metrics" config in a stable order.
+func (app App) MetricKeys() []string {
+	keys := make([]string, 0, len(app.SPMetrics))
+	for key := range app.SPMetrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 type Metric struct {
+	// App is the name of the app the metric was fetched for.
+	App        string  `json:"app"`
+	Key        string  `json:"key"`
 	SPApiKey   string  `json:"sp_api_key"`
 	SPPageId   string  `json:"sp_page_id"`
 	SPMetricId string  `json:"sp_metric_id"`
 	Value      float64 `json:"value"`
+	// Timestamp is when the value was observed by the source.
+	Timestamp  time.Time       `json:"timestamp"`
+	Sinks      []SinkConfig    `json:"sinks"`
+	Components []ComponentRule `json:"components"`
+	Incidents  []IncidentRule  `json:"incidents"`
+	// Stale is set on metrics the watchdog has caught, which aren't sent to
+	// sinks, and don't drive incidents.
+	Stale bool `json:"stale"`
+	// Sentinel is set on values the watchdog pushed in place of a stale
+	// metric, which are sent to sinks, but don't drive components or
+	// incidents.
+	Sentinel bool `json:"sentinel"`
+
+	// notReporting is set by sources that can tell the app they fetched the
+	// metric for has stopped reporting.
+	notReporting bool
+	// delivery is set when whoever sent the metric, like the Queue, needs
+	// to know how it went.
+	delivery *delivery
+	// backlog is set for metrics replayed from the Queue, which are too old
+	// to say anything about the current state of components and incidents.
+	backlog bool
 }
 
-type SPData struct {
-	Timestamp int32   `json:"timestamp"`
-	Value     float64 `json:"value"`
-}
-
-type SPPayload struct {
-	Data SPData `json:"data"`
-}
-
-func PollNR(config Config, app App, metrics chan Metric) {
-	// Initialise metrics
-	newrelicCounts.Add("errors.http.new", 0)
-	newrelicCounts.Add("errors.http.do", 0)
-	newrelicCounts.Add("errors.http.readbody", 0)
-	newrelicCounts.Add("errors.json.decode", 0)
-	newrelicCounts.Add("apps.response_time", 0)
-	newrelicCounts.Add("apps.throughput", 0)
-	newrelicCounts.Add("apps.error_rate", 0)
-	newrelicCounts.Add("requests", 0)
-
-	appid := strconv.Itoa(app.NRAppId)
-	parts := []string{config.NRBaseURL, appid, ".json"}
-	url := strings.Join(parts, "")
-
-	client := &http.Client{Timeout: time.Second * 5}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Printf("[error] PollNR: new request: %s\n", err)
-		newrelicCounts.Add("errors.http.new", 1)
-		return
-	}
-	req.Header.Set("X-Api-Key", app.NRApiKey)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("[error] PollNR: client do: %s\n", err)
-		newrelicCounts.Add("errors.http.do", 1)
-		return
-	}
-	newrelicCounts.Add("requests", 1)
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("[error] PollNR: couldn't read body: %s\n", err)
-		newrelicCounts.Add("errors.http.readbody", 1)
-		return
-	}
-
-	if config.Debug {
-		log.Printf("[debug] PollNR raw body: %s\n", body)
-	}
-
-	var sample ApplicationResponse
-	err = json.Unmarshal(body, &sample)
-	if err != nil {
-		log.Printf("[error] PollNR: couldn't decode json: %s", err)
-		log.Printf("[error] PollNR: raw body: %s\n", body)
-		newrelicCounts.Add("errors.json.decode", 1)
-		return
-	}
-	if config.Debug {
-		log.Printf("[debug] PollNR decoded JSON: %+v\n", sample)
-	}
-
-	m := Metric{SPPageId: app.SPPageId, SPApiKey: app.SPApiKey}
-
-	if _, ok := app.SPMetrics["response_time"]; ok {
-		if config.Debug {
-			log.Println("[debug] PollNR: Fetching response_time for", appid)
-		}
-		newrelicCounts.Add("apps.response_time", 1)
-		m.SPMetricId = app.SPMetrics["response_time"]
-		m.Value = sample.Application.ApplicationSummary.ResponseTime
-		metrics <- m
-	}
-
-	if _, ok := app.SPMetrics["throughput"]; ok {
-		if config.Debug {
-			log.Println("[debug] PollNR: Fetching throughput for nr_app_id", appid)
-		}
-		newrelicCounts.Add("apps.throughput", 1)
-		m.SPMetricId = app.SPMetrics["throughput"]
-		m.Value = sample.Application.ApplicationSummary.Throughput
-		metrics <- m
-	}
-
-	if _, ok := app.SPMetrics["error_rate"]; ok {
-		if config.Debug {
-			log.Println("[debug] PollNR: Fetching error_rate for", appid)
-		}
-		newrelicCounts.Add("apps.error_rate", 1)
-		m.SPMetricId = app.SPMetrics["error_rate"]
-		m.Value = sample.Application.ApplicationSummary.ErrorRate
-		metrics <- m
+// Time returns when the metric was observed, or now if its source didn't say.
+func (m Metric) Time() time.Time {
+	if m.Timestamp.IsZero() {
+		return time.Now()
 	}
+	return m.Timestamp
 }
 
 func Setup(config Config, apps *[]App) {
@@ -169,143 +176,281 @@ func Setup(config Config, apps *[]App) {
 		}
 	}()
 
-	contents, err := ioutil.ReadFile(config.ConfigPath)
+	loaded, err := LoadApps(config.ConfigPath)
 	if err != nil {
-		log.Printf("[error] Setup: couldn't read contents: %s\n", err)
+		log.Printf("[error] Setup: %s\n", err)
 		os.Exit(1)
 	}
+	*apps = loaded
+
+	log.Printf("[info] Setup: Tracking metrics from %d applications", len(*apps))
+}
+
+// LoadApps reads and validates the apps in the config file at path.
+func LoadApps(path string) ([]App, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read contents: %s", err)
+	}
+	var apps []App
 	err = json.Unmarshal(contents, &apps)
 	if err != nil {
-		log.Printf("[error] Setup: couldn't decode apps: %s\n", err)
-		log.Printf("[error] Setup: response contents: %s\n", string(contents))
-		os.Exit(1)
+		return nil, fmt.Errorf("couldn't decode apps: %s, contents: %s", err, string(contents))
 	}
-
-	log.Printf("[info] Setup: Tracking New Relic metrics from %d applications", len(*apps))
+	for _, app := range apps {
+		if err := app.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid app %s: %s", app.Name(), err)
+		}
+	}
+	return apps, nil
 }
 
+// Dispatch sends metrics on to their sinks until metrics is closed, and then
+// returns once everything it was sent has been delivered or failed.
 func Dispatch(config Config, metrics chan Metric) {
-	// Initialise metrics
-	statuspageCounts.Add("errors.json.marshal", 0)
-	statuspageCounts.Add("errors.http.new", 0)
-	statuspageCounts.Add("errors.http.do", 0)
-	statuspageCounts.Add("errors.http.readbody", 0)
-	statuspageCounts.Add("errors.http.status", 0)
-	statuspageCounts.Add("requests", 0)
-
-	for {
-		metric := <-metrics
-		parts := []string{config.SPBaseURL, "pages", metric.SPPageId, "metrics", metric.SPMetricId, "data.json"}
-		url := strings.Join(parts, "/")
-		if config.Debug {
-			log.Printf("[debug] Dispatch: URL: %s", url)
-		}
-
-		payload := SPPayload{
-			Data: SPData{
-				Timestamp: int32(time.Now().Unix()),
-				Value:     metric.Value,
-			},
-		}
-		body, err := json.Marshal(payload)
-		if err != nil {
-			log.Printf("[error] Dispatch: JSON marshal: %s\n", err)
-			statuspageCounts.Add("errors.json.marshal", 1)
-			continue
-		}
-		if config.Debug {
-			log.Printf("[debug] Dispatch: JSON marshal: %s", string(body))
-		}
-
-		client := &http.Client{Timeout: config.Timeout}
-		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
-		if err != nil {
-			log.Printf("[error] Dispatch: new request: %s\n", err)
-			statuspageCounts.Add("errors.http.new", 1)
-			continue
-		}
-		req.Header.Set("Authorization", "OAuth "+metric.SPApiKey)
-
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("[error] Dispatch: client do: %s\n", err)
-			statuspageCounts.Add("errors.http.do", 1)
-			continue
-		}
-		statuspageCounts.Add("requests", 1)
+	components := NewComponentDispatcher()
+	incidents := NewIncidentDispatcher()
+	batches := NewBatcher()
+	pool := NewPool(config.Workers)
+	config.pool = pool
+	var dry *DryRun
+	if config.DryRun {
+		dry = NewDryRun(config)
+	}
 
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("[error] Dispatch: couldn't read body: %s\n", err)
-			statuspageCounts.Add("errors.http.readbody", 1)
-			continue
-		}
+	// beat keeps the heartbeat going while there is nothing to do, so that
+	// /healthz can tell an idle Dispatch from a stuck one.
+	health.Dispatching(true)
+	defer health.Dispatching(false)
+	beat := time.NewTicker(time.Second)
+	defer beat.Stop()
 
-		if resp.StatusCode != 201 {
-			log.Printf("[error] Dispatch: StatusPage returned HTTP %d: %s\n", resp.StatusCode, string(body))
-			statuspageCounts.Add("errors.http.status", 1)
-			continue
+	// flush fires BatchWindow after the first metric of a batch arrives, by
+	// which time the rest of the poll cycle's metrics should have too.
+	var flush <-chan time.Time
+	for {
+		health.Beat()
+		select {
+		case <-beat.C:
+		case metric, ok := <-metrics:
+			if !ok {
+				batches.Flush(config, pool)
+				pool.Close()
+				return
+			}
+			for _, target := range metric.targets() {
+				sink, ok := Sinks[target.Type]
+				if !ok {
+					log.Printf("[error] Dispatch: unknown sink %q\n", target.Type)
+					metric.settle(nil)
+					continue
+				}
+				if metric.Stale {
+					metric.settle(nil)
+					continue
+				}
+				if dry != nil {
+					dry.Print(target, metric)
+					health.Dispatched()
+					metric.settle(nil)
+					continue
+				}
+				if _, ok := sink.(BatchSink); ok && config.BatchWindow > 0 {
+					batches.Add(target, metric)
+					if flush == nil {
+						flush = time.After(config.BatchWindow)
+					}
+					continue
+				}
+				target := target
+				pool.Submit(batchKey(target, metric), func() {
+					err := deliver(config, target.Type, func() error {
+						return sink.Publish(config, target, metric)
+					})
+					if err != nil {
+						log.Printf("[error] Dispatch: %s: %s\n", target.Type, err)
+					}
+					recordSubmission(target, metric, err)
+					metric.settle(err)
+				})
+			}
+			// A dry run mustn't change anything on StatusPage.
+			if dry != nil {
+				metric.settle(nil)
+			} else if !metric.backlog {
+				pool.Submit(pageKey(metric), func() {
+					err := components.Update(config, metric)
+					incidents.Update(config, metric)
+					metric.settle(err)
+				})
+			}
+		case <-flush:
+			flush = nil
+			batches.Flush(config, pool)
 		}
 	}
 }
 
-func Instrumentation(config Config) {
+// Instrumentation serves runtime statistics in the background, until the
+// server it returns is shut down.
+func Instrumentation(config Config) *http.Server {
 	log.Printf("[info] Instrumentation: Exposing runtime statistics at port %s", config.Port)
-	err := http.ListenAndServe(":"+config.Port, nil)
-	if err != nil {
-		log.Fatal("[error] ", err)
-	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", ServeHealthz)
+	mux.HandleFunc("/readyz", ServeReadyz(config))
+	mux.Handle("/", http.DefaultServeMux)
+	server := &http.Server{Addr: ":" + config.Port, Handler: mux}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("[error] ", err)
+		}
+	}()
+	return server
 }
 
-func Poll(config Config, apps []App, metrics chan Metric) {
+// Poll fetches every app's metrics in the background, adding each poll to
+// polls until it is done.
+func Poll(config Config, apps []App, metrics chan Metric, polls *sync.WaitGroup) {
 	log.Printf("[info] Poll: Fetching metrics for %d apps", len(apps))
 	for _, a := range apps {
-		go PollNR(config, a, metrics)
+		polls.Add(1)
+		go func(a App) {
+			defer polls.Done()
+			PollApp(config, a, metrics)
+		}(a)
 	}
 }
 
 var (
-	configPath = kingpin.Flag("config", "Path to Nudger's config").Default("nudger.json").OverrideDefaultFromEnvar("CONFIG_PATH").String()
-	debug      = kingpin.Flag("debug", "Toggle debug mode").Default("false").OverrideDefaultFromEnvar("DEBUG").Bool()
-	spBaseURL  = kingpin.Flag("statuspage-base-url", "StatusPage API base URL").Default("https://api.statuspage.io/v1").String()
-	nrBaseURL  = kingpin.Flag("newrelic-base-url", "New Relic API base URL").Default("https://api.newrelic.com/v2/applications/").String()
-	interval   = kingpin.Flag("interval", "Frequency to poll New Relic").Default("60s").OverrideDefaultFromEnvar("INTERVAL").Duration()
-	port       = kingpin.Flag("port", "Where Nudger's stats can be accessed").Default("8181").OverrideDefaultFromEnvar("PORT").String()
+	configPath      = kingpin.Flag("config", "Path to Nudger's config").Default("nudger.json").OverrideDefaultFromEnvar("CONFIG_PATH").String()
+	debug           = kingpin.Flag("debug", "Toggle debug mode").Default("false").OverrideDefaultFromEnvar("DEBUG").Bool()
+	dryRun          = kingpin.Flag("dry-run", "Fetch metrics, but print what would be sent instead of sending it").Default("false").OverrideDefaultFromEnvar("DRY_RUN").Bool()
+	dryRunFormat    = kingpin.Flag("dry-run-format", "How to print a dry run: table or json (one object per line)").Default("table").Enum(DryRunFormats...)
+	spBaseURL       = kingpin.Flag("statuspage-base-url", "StatusPage API base URL").Default("https://api.statuspage.io/v1").String()
+	nrBaseURL       = kingpin.Flag("newrelic-base-url", "New Relic API base URL").Default("https://api.newrelic.com/v2/applications/").String()
+	insightsBaseURL = kingpin.Flag("insights-base-url", "New Relic Insights query API base URL").Default("https://insights-api.newrelic.com/v1/accounts/").String()
+	nerdgraphURL    = kingpin.Flag("nerdgraph-url", "New Relic NerdGraph (GraphQL) API URL").Default("https://api.newrelic.com/graphql").String()
+	interval        = kingpin.Flag("interval", "Frequency to poll New Relic").Default("60s").OverrideDefaultFromEnvar("INTERVAL").Duration()
+	batchWindow     = kingpin.Flag("batch-window", "How long to gather metrics for bulk submission to StatusPage (0 to disable)").Default("10s").OverrideDefaultFromEnvar("BATCH_WINDOW").Duration()
+	retries         = kingpin.Flag("retries", "How many times to retry a failed submission to StatusPage").Default("3").OverrideDefaultFromEnvar("RETRIES").Int()
+	retryBackoff    = kingpin.Flag("retry-backoff", "How long to wait before the first retry, doubling each time").Default("1s").Duration()
+	retryMaxBackoff = kingpin.Flag("retry-max-backoff", "The longest to wait between retries, or 0 for no limit").Default("30s").Duration()
+	queueDir        = kingpin.Flag("queue-dir", "Directory to queue metrics in until they are delivered (empty to disable)").Default("").OverrideDefaultFromEnvar("QUEUE_DIR").String()
+	queueMaxSize    = kingpin.Flag("queue-max-size", "The most metrics to queue, dropping the oldest beyond that").Default("10000").OverrideDefaultFromEnvar("QUEUE_MAX_SIZE").Int()
+	queueMaxAge     = kingpin.Flag("queue-max-age", "The oldest a queued metric can be before it is dropped").Default("24h").OverrideDefaultFromEnvar("QUEUE_MAX_AGE").Duration()
+	rateLimit       = kingpin.Flag("rate-limit", "Requests a second to allow to each StatusPage page (0 for no limit)").Default("1").OverrideDefaultFromEnvar("RATE_LIMIT").Float()
+	rateBurst       = kingpin.Flag("rate-burst", "Requests to allow to a StatusPage page at once after a quiet spell").Default("1").OverrideDefaultFromEnvar("RATE_BURST").Int()
+	workers         = kingpin.Flag("workers", "How many submissions to make at once, across all pages").Default("4").OverrideDefaultFromEnvar("WORKERS").Int()
+	shutdownTimeout = kingpin.Flag("shutdown-timeout", "How long to spend delivering metrics already fetched when asked to stop").Default("30s").OverrideDefaultFromEnvar("SHUTDOWN_TIMEOUT").Duration()
+	readyWindow     = kingpin.Flag("ready-window", "How recently Nudger must have polled and dispatched to be ready").Default("5m").OverrideDefaultFromEnvar("READY_WINDOW").Duration()
+	port            = kingpin.Flag("port", "Where Nudger's stats can be accessed").Default("8181").OverrideDefaultFromEnvar("PORT").String()
+
+	_               = kingpin.Command("run", "Poll apps and push their metrics, forever (the default).")
+	_               = kingpin.Command("once", "Poll apps and push their metrics once, then exit.")
+	validateCommand = kingpin.Command("validate", "Check the config strictly, reporting every problem found.")
+	validatePath    = validateCommand.Arg("config", "Path to the config to check (defaults to --config)").String()
 )
 
 func main() {
 	kingpin.Version("1.0.0")
-	kingpin.Parse()
+	command := kingpin.MustParse(kingpin.CommandLine.Parse(os.Args[1:]))
+
+	switch command {
+	case "validate":
+		path := *validatePath
+		if path == "" {
+			path = *configPath
+		}
+		os.Exit(Validate(path, os.Stdout))
+	}
 
 	config := Config{
-		Interval:   *interval,
-		ConfigPath: *configPath,
-		Timeout:    time.Second * 5,
-		Debug:      *debug,
-		SPBaseURL:  *spBaseURL,
-		NRBaseURL:  *nrBaseURL,
-		Port:       *port,
+		Interval:        *interval,
+		ConfigPath:      *configPath,
+		Timeout:         time.Second * 5,
+		BatchWindow:     *batchWindow,
+		Retries:         *retries,
+		RetryBackoff:    *retryBackoff,
+		RetryMaxBackoff: *retryMaxBackoff,
+		Client:          &http.Client{Timeout: time.Second * 5},
+		Debug:           *debug,
+		DryRun:          *dryRun,
+		DryRunFormat:    *dryRunFormat,
+		SPBaseURL:       *spBaseURL,
+		NRBaseURL:       *nrBaseURL,
+		InsightsBaseURL: *insightsBaseURL,
+		NerdGraphURL:    *nerdgraphURL,
+		Port:            *port,
+		ShutdownTimeout: *shutdownTimeout,
+		ReadyWindow:     *readyWindow,
+		RateLimit:       *rateLimit,
+		RateBurst:       *rateBurst,
+		Workers:         *workers,
+		QueueDir:        *queueDir,
+		QueueMaxSize:    *queueMaxSize,
+		QueueMaxAge:     *queueMaxAge,
 	}
 	if config.Debug {
 		log.Printf("[debug] Main: config: %+v\n", config)
 	}
 
-	go Instrumentation(config)
+	if command == "once" {
+		var apps []App
+		Setup(config, &apps)
+		os.Exit(Once(config, apps, os.Stdout))
+	}
 
-	var apps []App
-	Setup(config, &apps)
+	p := &Pipeline{
+		Metrics:    make(chan Metric),
+		Dispatched: make(chan struct{}),
+	}
+	p.Server = Instrumentation(config)
+
+	var loaded []App
+	Setup(config, &loaded)
+	apps := NewApps(loaded)
+	health.ConfigLoaded()
+	go apps.Watch(config)
+
+	go func() {
+		Dispatch(config, p.Metrics)
+		close(p.Dispatched)
+	}()
+
+	// With a queue, pollers hand metrics to the queue, and the queue feeds
+	// Dispatch.
+	p.Polled = p.Metrics
+	// A dry run leaves anything queued for a real run alone.
+	if config.QueueDir != "" && !config.DryRun {
+		queue, err := OpenQueue(config)
+		if err != nil {
+			log.Printf("[error] Main: couldn't open queue: %s\n", err)
+			os.Exit(1)
+		}
+		p.Queue = queue
+		p.Polled = make(chan Metric)
+		queue.Start(config, p.Polled, p.Metrics)
+	}
 
-	metrics := make(chan Metric)
-	go Dispatch(config, metrics)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
 	// Get metrics the first time
-	Poll(config, apps, metrics)
+	Poll(config, apps.Get(), p.Polled, &p.Polls)
 
-	tick := time.NewTicker(config.Interval).C
+	tick := time.NewTicker(config.Interval)
 	for {
 		select {
-		case <-tick:
-			Poll(config, apps, metrics)
+		case <-tick.C:
+			Poll(config, apps.Get(), p.Polled, &p.Polls)
+		case sig := <-signals:
+			tick.Stop()
+			log.Printf("[info] Main: %s received, shutting down", sig)
+			if !Shutdown(config, p) {
+				os.Exit(1)
+			}
+			return
 		}
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Once polls every app a single time, waits until Dispatch has delivered, or
+// failed to deliver, every metric that turns up, and writes a summary to w.
+// It returns the status `nudger once` should exit with: non-zero if anything
+// went wrong.
+//
+// A single run can't tell a sustained breach from a blip, so incident rules
+// are left alone. Component rules are applied as usual.
+func Once(config Config, apps []App, w io.Writer) int {
+	metrics := make(chan Metric)
+	dispatched := make(chan struct{})
+	go func() {
+		Dispatch(config, metrics)
+		close(dispatched)
+	}()
+
+	var mu sync.Mutex
+	var expected, fetched, delivered int
+	var failures []string
+	fail := func(format string, args ...interface{}) {
+		mu.Lock()
+		failures = append(failures, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+
+	var polls, deliveries sync.WaitGroup
+	for i, app := range apps {
+		expected += len(app.SPMetrics)
+		polls.Add(1)
+		go func(i int, app App) {
+			defer polls.Done()
+
+			polled := make(chan Metric)
+			go func() {
+				PollApp(config, app, polled)
+				close(polled)
+			}()
+
+			var n int
+			for m := range polled {
+				n++
+				m.Incidents = nil
+				m.delivery = &delivery{
+					remaining: m.steps(),
+					done: func(m Metric) func(error) {
+						return func(err error) {
+							if _, ok := err.(*ComponentError); ok {
+								fail("$[%d].metrics.%s: couldn't update %s", i, m.Key, err)
+							} else if err != nil {
+								fail("$[%d].metrics.%s: couldn't deliver: %s", i, m.Key, err)
+							} else {
+								mu.Lock()
+								delivered++
+								mu.Unlock()
+							}
+							deliveries.Done()
+						}
+					}(m),
+				}
+				deliveries.Add(1)
+				metrics <- m
+			}
+
+			mu.Lock()
+			fetched += n
+			mu.Unlock()
+			if n < len(app.SPMetrics) {
+				fail("$[%d]: fetched %d of %d metrics from %s", i, n, len(app.SPMetrics), app.SourceName())
+			}
+		}(i, app)
+	}
+	polls.Wait()
+	deliveries.Wait()
+	close(metrics)
+	<-dispatched
+
+	for _, failure := range failures {
+		fmt.Fprintln(w, failure)
+	}
+	fmt.Fprintf(w, "Fetched %d of %d metrics from %d apps, delivered %d\n", fetched, expected, len(apps), delivered)
+	if len(failures) > 0 {
+		return 1
+	}
+	return 0
+}
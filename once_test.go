@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOnce(t *testing.T) {
+	Sources["mock"] = MockSource{Metrics: []Metric{
+		{Key: "a", SPPageId: "page", SPMetricId: "a", Value: 1},
+		{Key: "b", SPPageId: "page", SPMetricId: "b", Value: 2},
+	}}
+	defer delete(Sources, "mock")
+	app := App{Source: "mock", SPPageId: "page", SPMetrics: map[string]MetricConfig{"a": {SPMetricId: "a"}, "b": {SPMetricId: "b"}}}
+
+	sp, requests := MockFlakyStatusPage(0, 0, "")
+	defer sp.Close()
+	config := Config{SPBaseURL: sp.URL + "/v1", BatchWindow: 10 * time.Millisecond}
+
+	var out bytes.Buffer
+	if status := Once(config, []App{app}, &out); status != 0 {
+		t.Fatalf("Expected once to succeed, got %d: %s", status, out.String())
+	}
+	if *requests != 1 {
+		t.Fatalf("Expected both metrics in one bulk request, got %d requests", *requests)
+	}
+	if !strings.Contains(out.String(), "Fetched 2 of 2 metrics from 1 apps, delivered 2") {
+		t.Fatalf("Expected a summary, got: %s", out.String())
+	}
+}
+
+func TestOnceFailsOnComponents(t *testing.T) {
+	Sources["mock"] = MockSource{Metrics: []Metric{{Key: "a", SPPageId: "page", SPMetricId: "a", Value: 10}}}
+	defer delete(Sources, "mock")
+	app := App{Source: "mock", SPPageId: "page", SPMetrics: map[string]MetricConfig{"a": {SPMetricId: "a"}}}
+	app.Components = []ComponentRule{{Metric: "a", ComponentId: "api", Thresholds: map[string]float64{"major_outage": 5}}}
+
+	sp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/components/") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer sp.Close()
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+
+	var out bytes.Buffer
+	if status := Once(config, []App{app}, &out); status == 0 {
+		t.Fatalf("Expected once to fail, got: %s", out.String())
+	}
+	if !strings.Contains(out.String(), "$[0].metrics.a: couldn't update components: StatusPage returned HTTP 401") {
+		t.Fatalf("Expected the component failure in the summary, got: %s", out.String())
+	}
+}
+
+func TestOnceFails(t *testing.T) {
+	Sources["mock"] = MockSource{Metrics: []Metric{{Key: "a", SPPageId: "page", SPMetricId: "a", Value: 1}}}
+	defer delete(Sources, "mock")
+	app := App{Source: "mock", SPPageId: "page", SPMetrics: map[string]MetricConfig{"a": {SPMetricId: "a"}, "b": {SPMetricId: "b"}}}
+
+	sp, _ := MockFlakyStatusPage(10, http.StatusUnauthorized, "")
+	defer sp.Close()
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+
+	var out bytes.Buffer
+	if status := Once(config, []App{app}, &out); status == 0 {
+		t.Fatalf("Expected once to fail, got: %s", out.String())
+	}
+	for _, expected := range []string{
+		"$[0]: fetched 1 of 2 metrics from mock",
+		"$[0].metrics.a: couldn't deliver: StatusPage",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("Expected %q in the summary, got: %s", expected, out.String())
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	poolCounts  = expvar.NewMap("pool")
+	poolBusy    = new(expvar.Int)
+	poolPending = new(expvar.Int)
+)
+
+func init() {
+	poolCounts.Set("busy", poolBusy)
+	poolCounts.Set("pending", poolPending)
+}
+
+// Pool does work for different StatusPage pages at the same time, with no
+// more than a fixed number of jobs running at once. Work submitted under the
+// same key is done one job at a time, in the order it was submitted.
+type Pool struct {
+	slots chan struct{}
+
+	mu      sync.Mutex
+	lanes   map[string]*lane
+	workers sync.WaitGroup
+}
+
+// lane is the work waiting for a key. It has a goroutine working through it
+// while running is set.
+type lane struct {
+	jobs    []func()
+	running bool
+}
+
+// NewPool returns a pool of workers workers, or one if workers isn't positive.
+func NewPool(workers int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Pool{
+		slots: make(chan struct{}, workers),
+		lanes: make(map[string]*lane),
+	}
+}
+
+// Submit queues job to run after any work already submitted under key. It
+// never blocks, however far behind the key's work is, so that a page that's
+// struggling doesn't hold up Dispatch for the others.
+func (p *Pool) Submit(key string, job func()) {
+	// Initialise metrics
+	poolCounts.Add("lanes", 0)
+
+	poolPending.Add(1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.lanes[key]
+	if !ok {
+		l = &lane{}
+		p.lanes[key] = l
+		poolCounts.Add("lanes", 1)
+	}
+	l.jobs = append(l.jobs, job)
+	if !l.running {
+		l.running = true
+		p.workers.Add(1)
+		go p.work(l)
+	}
+}
+
+// Close waits for the work already submitted to be done. Nothing more can be
+// submitted afterwards.
+func (p *Pool) Close() {
+	p.workers.Wait()
+}
+
+// Sleep waits for d without taking up a worker, so that jobs waiting on a rate
+// limit or a retry don't hold up work for other pages. It must only be called
+// from a job running in the pool.
+func (p *Pool) Sleep(d time.Duration) {
+	poolBusy.Add(-1)
+	<-p.slots
+	time.Sleep(d)
+	p.slots <- struct{}{}
+	poolBusy.Add(1)
+}
+
+// pageKey identifies the work for metric's StatusPage page.
+func pageKey(metric Metric) string {
+	return metric.SPPageId + "\x00" + metric.SPApiKey
+}
+
+func (p *Pool) work(l *lane) {
+	defer p.workers.Done()
+	for {
+		p.mu.Lock()
+		if len(l.jobs) == 0 {
+			l.running = false
+			p.mu.Unlock()
+			return
+		}
+		job := l.jobs[0]
+		l.jobs[0] = nil
+		l.jobs = l.jobs[1:]
+		p.mu.Unlock()
+
+		p.slots <- struct{}{}
+		poolBusy.Add(1)
+		job()
+		poolBusy.Add(-1)
+		poolPending.Add(-1)
+		<-p.slots
+	}
+}
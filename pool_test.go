@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolKeepsOrderWithinKey(t *testing.T) {
+	pool := NewPool(4)
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		pool.Submit("page", func() {
+			defer wg.Done()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	for i, n := range order {
+		if n != i {
+			t.Fatalf("Expected jobs to run in order, got %v", order)
+		}
+	}
+}
+
+func TestPoolRunsKeysConcurrently(t *testing.T) {
+	pool := NewPool(2)
+
+	// A slow page shouldn't hold up another page's work.
+	release := make(chan struct{})
+	pool.Submit("slow", func() { <-release })
+	done := make(chan struct{})
+	pool.Submit("fast", func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected work for another page to run while the slow page was busy")
+	}
+	close(release)
+}
+
+func TestPoolLimitsWorkers(t *testing.T) {
+	pool := NewPool(2)
+
+	var running, most int32
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		wg.Add(1)
+		pool.Submit(key, func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+
+	if most > 2 {
+		t.Fatalf("Expected at most 2 jobs at once, got %d", most)
+	}
+}
+
+func TestPoolSubmitDoesNotBlock(t *testing.T) {
+	pool := NewPool(1)
+
+	// However far behind a page gets, Submit comes straight back.
+	release := make(chan struct{})
+	submitted := make(chan struct{})
+	go func() {
+		pool.Submit("slow", func() { <-release })
+		for i := 0; i < 500; i++ {
+			pool.Submit("slow", func() {})
+		}
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Submit not to block behind a busy page")
+	}
+	close(release)
+	pool.Close()
+}
+
+func TestPoolSleepFreesWorker(t *testing.T) {
+	pool := NewPool(1)
+	config := Config{pool: pool}
+
+	// A job waiting on a rate limit or a retry shouldn't hold up another
+	// page's work.
+	done := make(chan struct{})
+	pool.Submit("throttled", func() { config.sleep(500 * time.Millisecond) })
+	time.Sleep(10 * time.Millisecond)
+	pool.Submit("other", func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("Expected work for another page to run while the throttled page slept")
+	}
+	pool.Close()
+}
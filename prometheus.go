@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var prometheusCounts = expvar.NewMap("prometheus")
+
+// PromResponse is the envelope returned by the Prometheus HTTP API.
+type PromResponse struct {
+	Status    string     `json:"status"`
+	ErrorType string     `json:"errorType"`
+	Error     string     `json:"error"`
+	Data      PromResult `json:"data"`
+}
+
+type PromResult struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+type PromSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  PromValue         `json:"value"`
+}
+
+// PromValue is a [timestamp, "value"] pair, as Prometheus encodes samples.
+type PromValue []interface{}
+
+// Time returns when the sample was taken.
+func (v PromValue) Time() (time.Time, error) {
+	if len(v) != 2 {
+		return time.Time{}, fmt.Errorf("malformed sample: %v", []interface{}(v))
+	}
+	ts, ok := v[0].(float64)
+	if !ok {
+		return time.Time{}, fmt.Errorf("malformed sample timestamp: %v", v[0])
+	}
+	sec, frac := math.Modf(ts)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// Float returns the sample's value. Prometheus writes the results of things
+// like 0/0 rates as "NaN" or "+Inf", which can't be sent on as JSON, so those
+// are rejected.
+func (v PromValue) Float() (float64, error) {
+	if len(v) != 2 {
+		return 0, fmt.Errorf("malformed sample: %v", []interface{}(v))
+	}
+	s, ok := v[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("malformed sample value: %v", v[1])
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("non-finite sample value: %s", s)
+	}
+	return f, nil
+}
+
+// Prometheus is the Source that runs a PromQL instant query per metric against
+// a Prometheus-compatible /api/v1/query endpoint.
+type Prometheus struct{}
+
+// Validate checks that the app says where Prometheus is, and that every metric
+// has a query.
+func (Prometheus) Validate(app App) error {
+	if app.PrometheusURL == "" {
+		return configError("prometheus_url", "missing")
+	}
+	for _, key := range app.MetricKeys() {
+		if app.SPMetrics[key].Query == "" {
+			return configError("metrics."+key, "missing query")
+		}
+	}
+	return nil
+}
+
+func (Prometheus) Fetch(config Config, app App) ([]Metric, error) {
+	// Initialise metrics
+	prometheusCounts.Add("errors.query", 0)
+	prometheusCounts.Add("errors.result", 0)
+
+	var metrics []Metric
+	for _, key := range app.MetricKeys() {
+		value, timestamp, err := queryPrometheus(config, app.PrometheusURL, app.SPMetrics[key].Query)
+		if err != nil {
+			log.Printf("[error] PollPrometheus: metric %s: %s\n", key, err)
+			continue
+		}
+		if config.Debug {
+			log.Printf("[debug] PollPrometheus: %s = %f\n", key, value)
+		}
+		metrics = append(metrics, Metric{
+			Key:        key,
+			SPApiKey:   app.SPApiKey,
+			SPPageId:   app.SPPageId,
+			SPMetricId: app.SPMetrics[key].SPMetricId,
+			Value:      value,
+			Timestamp:  timestamp,
+		})
+	}
+	return metrics, nil
+}
+
+// queryPrometheus runs an instant query, expecting a scalar or a vector with a
+// single sample in return.
+func queryPrometheus(config Config, base string, query string) (float64, time.Time, error) {
+	u := strings.TrimRight(base, "/") + "/api/v1/query?" + url.Values{"query": {query}}.Encode()
+
+	var response PromResponse
+	status, err := fetchJSON(config, prometheusCounts, "PollPrometheus", u, nil, &response)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if response.Status != "success" {
+		prometheusCounts.Add("errors.query", 1)
+		return 0, time.Time{}, fmt.Errorf("query failed (HTTP %d): %s: %s", status, response.ErrorType, response.Error)
+	}
+
+	var value PromValue
+	switch response.Data.ResultType {
+	case "scalar":
+		err = json.Unmarshal(response.Data.Result, &value)
+	case "vector":
+		var samples []PromSample
+		err = json.Unmarshal(response.Data.Result, &samples)
+		if err == nil && len(samples) != 1 {
+			err = fmt.Errorf("expected 1 sample, got %d", len(samples))
+		}
+		if err == nil {
+			value = samples[0].Value
+		}
+	default:
+		err = fmt.Errorf("unsupported result type %q", response.Data.ResultType)
+	}
+	if err != nil {
+		prometheusCounts.Add("errors.result", 1)
+		return 0, time.Time{}, err
+	}
+
+	f, err := value.Float()
+	if err != nil {
+		prometheusCounts.Add("errors.result", 1)
+		return 0, time.Time{}, err
+	}
+	timestamp, err := value.Time()
+	if err != nil {
+		prometheusCounts.Add("errors.result", 1)
+		return 0, time.Time{}, err
+	}
+	return f, timestamp, nil
+}
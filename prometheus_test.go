@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func MockPrometheus(results map[string]string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, ok := results[r.URL.Query().Get("query")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+			return
+		}
+		w.Write([]byte(result))
+	}))
+	return ts
+}
+
+func TestPrometheusQuery(t *testing.T) {
+	prom := MockPrometheus(map[string]string{
+		"latency": `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1435781451.781,"0.25"]}]}}`,
+		"up":      `{"status":"success","data":{"resultType":"scalar","result":[1435781451.781,"1"]}}`,
+		"many":    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"1"]},{"metric":{},"value":[1,"2"]}]}}`,
+		"nan":     `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1435781451.781,"NaN"]}]}}`,
+		"inf":     `{"status":"success","data":{"resultType":"scalar","result":[1435781451.781,"+Inf"]}}`,
+	})
+	defer prom.Close()
+
+	app := App{
+		Source:        "prometheus",
+		PrometheusURL: prom.URL,
+		SPPageId:      "page",
+		SPMetrics: map[string]MetricConfig{
+			"latency": {SPMetricId: "lat", Query: "latency"},
+			"up":      {SPMetricId: "up", Query: "up"},
+			"many":    {SPMetricId: "many", Query: "many"},
+			"broken":  {SPMetricId: "broken", Query: "broken("},
+			"nan":     {SPMetricId: "nan", Query: "nan"},
+			"inf":     {SPMetricId: "inf", Query: "inf"},
+		},
+	}
+	before := counterValue(prometheusCounts, "errors.result")
+	metrics, err := Prometheus{}.Fetch(Config{}, app)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	expected := map[string]float64{"lat": 0.25, "up": 1}
+	if len(metrics) != len(expected) {
+		t.Fatalf("Expected %d metrics, got: %+v", len(expected), metrics)
+	}
+	// many, nan and inf.
+	if after := counterValue(prometheusCounts, "errors.result"); after != before+3 {
+		t.Fatalf("Expected errors.result to go from %d to %d, got %d", before, before+3, after)
+	}
+	for _, m := range metrics {
+		if m.Value != expected[m.SPMetricId] {
+			t.Fatalf("Expected %s to be %f, got %f", m.SPMetricId, expected[m.SPMetricId], m.Value)
+		}
+		if m.Timestamp.Unix() != 1435781451 {
+			t.Fatalf("Expected %s to be timestamped 1435781451, got %d", m.SPMetricId, m.Timestamp.Unix())
+		}
+	}
+}
+
+func TestPrometheusValidate(t *testing.T) {
+	var apps []App
+	config := `[{"source": "prometheus", "prometheus_url": "http://localhost:9090", "sp_page_id": "page",
+		"metrics": {"latency": {"sp_metric_id": "lat", "query": "histogram_quantile(0.95, rate(http_duration_bucket[5m]))"}}}]`
+	if err := json.Unmarshal([]byte(config), &apps); err != nil {
+		t.Fatalf("Expected config to decode, got: %s", err)
+	}
+	if err := apps[0].Validate(); err != nil {
+		t.Fatalf("Expected app to be valid, got: %s", err)
+	}
+
+	apps[0].SPMetrics["latency"] = MetricConfig{SPMetricId: "lat"}
+	if err := apps[0].Validate(); err == nil {
+		t.Fatal("Expected an error for a metric without a query, got nil")
+	}
+}
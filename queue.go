@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	queueCounts   = expvar.NewMap("queue")
+	queueDepth    = new(expvar.Int)
+	queueInflight = new(expvar.Int)
+	queueOldest   = new(expvar.Int)
+)
+
+func init() {
+	queueCounts.Set("depth", queueDepth)
+	queueCounts.Set("inflight", queueInflight)
+	queueCounts.Set("oldest_age_seconds", queueOldest)
+}
+
+// delivery tracks a metric's progress through its sinks, so that whoever sent
+// it on can be told once every sink has had a go.
+type delivery struct {
+	mu        sync.Mutex
+	remaining int
+	err       error
+	done      func(error)
+}
+
+// steps returns how many times Dispatch will settle the metric: once for
+// each sink, and once for its component and incident rules.
+func (m Metric) steps() int {
+	if m.backlog {
+		return len(m.targets())
+	}
+	return len(m.targets()) + 1
+}
+
+// settle records that one of the metric's steps is done with it. Once they
+// all are, the sender is told about the first failure, preferring one that
+// might go away if the metric is sent again.
+func (m Metric) settle(err error) {
+	d := m.delivery
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if err != nil && (d.err == nil || !retryable(d.err) && retryable(err)) {
+		d.err = err
+	}
+	d.remaining--
+	finished := d.remaining == 0
+	d.mu.Unlock()
+
+	if finished {
+		d.done(d.err)
+	}
+}
+
+// Queue is a write-ahead queue of metrics on disk, between the pollers and
+// Dispatch. Every metric is written to its own file before it is dispatched,
+// and only removed once its sinks have accepted it, or rejected it in a way
+// that retrying won't fix. Whatever is left over when Nudger stops is sent
+// when it starts again.
+type Queue struct {
+	dir     string
+	maxSize int
+	maxAge  time.Duration
+
+	mu  sync.Mutex
+	seq int64
+	// inflight is true for files Dispatch has yet to finish with, and false
+	// for those it has failed to deliver at least once, or that were left
+	// over from before Nudger started.
+	inflight map[string]bool
+	failed   bool
+
+	wake chan struct{}
+	// stop is closed to stop feeding Dispatch, and running lets Stop wait
+	// for that, and for everything sent to be written.
+	stop    chan struct{}
+	running sync.WaitGroup
+}
+
+// OpenQueue opens, creating if necessary, the queue in config.QueueDir.
+func OpenQueue(config Config) (*Queue, error) {
+	if err := os.MkdirAll(config.QueueDir, 0700); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:      config.QueueDir,
+		maxSize:  config.QueueMaxSize,
+		maxAge:   config.QueueMaxAge,
+		inflight: make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	names, err := q.names()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		log.Printf("[info] Queue: replaying %d metrics from %s\n", len(names), q.dir)
+	}
+	for _, name := range names {
+		q.inflight[name] = false
+	}
+	q.measure(names)
+	return q, nil
+}
+
+// names returns the files in the queue, oldest first. Files are named after
+// the metric's timestamp, so that sorting them by name sorts them by when
+// they were observed.
+func (q *Queue) names() ([]string, error) {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// measure updates the queue gauges.
+func (q *Queue) measure(names []string) {
+	queueDepth.Set(int64(len(names)))
+	var inflight int64
+	q.mu.Lock()
+	for _, busy := range q.inflight {
+		if busy {
+			inflight++
+		}
+	}
+	q.mu.Unlock()
+	queueInflight.Set(inflight)
+
+	queueOldest.Set(0)
+	if len(names) > 0 {
+		var nanos int64
+		fmt.Sscanf(names[0], "%d-", &nanos)
+		queueOldest.Set(int64(time.Since(time.Unix(0, nanos)).Seconds()))
+	}
+}
+
+// Put writes a metric to the queue, making room for it if the queue is full.
+func (q *Queue) Put(m Metric) error {
+	// Initialise metrics
+	queueCounts.Add("errors.write", 0)
+	queueCounts.Add("dropped", 0)
+
+	// Pin the time down, so it doesn't move each time the metric is read.
+	m.Timestamp = m.Time()
+
+	q.mu.Lock()
+	q.seq++
+	name := fmt.Sprintf("%020d-%06d.json", m.Time().UnixNano(), q.seq%1000000)
+	q.mu.Unlock()
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		queueCounts.Add("errors.write", 1)
+		return err
+	}
+	// Write then rename, so that a crash never leaves half a metric behind.
+	tmp := filepath.Join(q.dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		queueCounts.Add("errors.write", 1)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		queueCounts.Add("errors.write", 1)
+		return err
+	}
+
+	names, err := q.names()
+	if err != nil {
+		return err
+	}
+	for q.maxSize > 0 && len(names) > q.maxSize {
+		log.Printf("[error] Queue: full, dropping %s\n", names[0])
+		q.remove(names[0])
+		queueCounts.Add("dropped", 1)
+		names = names[1:]
+	}
+	q.measure(names)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *Queue) remove(name string) {
+	if err := os.Remove(filepath.Join(q.dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[error] Queue: couldn't remove %s: %s\n", name, err)
+	}
+}
+
+// Start writes every metric sent by the pollers on in to the queue, until in
+// is closed, and feeds queued metrics to Dispatch on out, until Stop is
+// called. Writing to disk is quick, so pollers are never held up by a slow
+// sink.
+func (q *Queue) Start(config Config, in chan Metric, out chan Metric) {
+	// Added before the goroutines start, so that a Stop straight away still
+	// waits for them.
+	q.running.Add(2)
+	go func() {
+		defer q.running.Done()
+		q.accept(in)
+	}()
+	go func() {
+		defer q.running.Done()
+		q.feed(config, out)
+	}()
+}
+
+func (q *Queue) accept(in chan Metric) {
+	for m := range in {
+		if err := q.Put(m); err != nil {
+			log.Printf("[error] Queue: couldn't write metric %s: %s\n", m.SPMetricId, err)
+		}
+	}
+}
+
+// feed sends queued metrics to Dispatch, oldest first. When a metric can't
+// be delivered, the queue stops feeding for config.RetryMaxBackoff (or
+// DefaultQueuePause, if that's 0 for no limit), so that a sink that is down
+// isn't hammered with the whole backlog. It carries on until Stop is called.
+func (q *Queue) feed(config Config, out chan Metric) {
+	// Initialise metrics
+	queueCounts.Add("errors.read", 0)
+	queueCounts.Add("expired", 0)
+	queueCounts.Add("delivered", 0)
+	queueCounts.Add("failed", 0)
+
+	for {
+		names, err := q.names()
+		if err != nil {
+			log.Printf("[error] Queue: couldn't list %s: %s\n", q.dir, err)
+		}
+		q.measure(names)
+
+		for _, name := range names {
+			if q.halted() {
+				break
+			}
+			q.mu.Lock()
+			busy := q.inflight[name]
+			q.mu.Unlock()
+			if busy {
+				continue
+			}
+
+			m, err := q.read(name)
+			if err != nil {
+				log.Printf("[error] Queue: couldn't read %s, dropping it: %s\n", name, err)
+				queueCounts.Add("errors.read", 1)
+				q.remove(name)
+				continue
+			}
+			if q.maxAge > 0 && time.Since(m.Time()) > q.maxAge {
+				log.Printf("[error] Queue: %s is older than %s, dropping it\n", name, q.maxAge)
+				queueCounts.Add("expired", 1)
+				q.remove(name)
+				continue
+			}
+
+			q.mu.Lock()
+			failed, seen := q.inflight[name]
+			q.inflight[name] = true
+			q.mu.Unlock()
+			m.delivery = &delivery{
+				remaining: m.steps(),
+				done:      q.acker(name),
+			}
+			select {
+			case out <- m:
+			case <-q.stop:
+				// Leave it for next time.
+				q.mu.Lock()
+				if seen {
+					q.inflight[name] = failed
+				} else {
+					delete(q.inflight, name)
+				}
+				q.mu.Unlock()
+				return
+			}
+		}
+
+		if q.halted() {
+			q.mu.Lock()
+			q.failed = false
+			q.mu.Unlock()
+			select {
+			case <-time.After(queuePause(config)):
+			case <-q.stop:
+				return
+			}
+			continue
+		}
+		select {
+		case <-q.wake:
+		case <-time.After(time.Second):
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// Stop waits for the queue to write what it has been sent, which it does once
+// in is closed, and stops feeding Dispatch. Anything not yet delivered is left
+// on disk for next time.
+func (q *Queue) Stop() {
+	close(q.stop)
+	q.running.Wait()
+}
+
+// DefaultQueuePause is how long the queue stops feeding for after a failure when
+// RetryMaxBackoff doesn't say.
+const DefaultQueuePause = 30 * time.Second
+
+func queuePause(config Config) time.Duration {
+	if config.RetryMaxBackoff > 0 {
+		return config.RetryMaxBackoff
+	}
+	return DefaultQueuePause
+}
+
+func (q *Queue) halted() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.failed
+}
+
+func (q *Queue) read(name string) (Metric, error) {
+	var m Metric
+	body, err := ioutil.ReadFile(filepath.Join(q.dir, name))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(body, &m)
+	// Metrics from before we started, or that have failed before, are part of
+	// a backlog rather than live data.
+	q.mu.Lock()
+	_, m.backlog = q.inflight[name]
+	q.mu.Unlock()
+	return m, err
+}
+
+// acker returns the function Dispatch calls once it has finished with the
+// metric in the named file.
+func (q *Queue) acker(name string) func(error) {
+	return func(err error) {
+		// Components are only updated from fresh metrics, so there's no
+		// point sending one again for them.
+		if _, ok := err.(*ComponentError); ok {
+			err = nil
+		}
+		// Metrics that were rejected in a way that retrying won't fix are
+		// dropped, like delivered ones.
+		if err != nil && !retryable(err) {
+			log.Printf("[error] Queue: dropping %s: %s\n", name, err)
+			err = nil
+		}
+		q.mu.Lock()
+		if err != nil {
+			// Keep the file, and note that it failed so it counts as
+			// backlog when it is sent again.
+			q.inflight[name] = false
+			q.failed = true
+		} else {
+			delete(q.inflight, name)
+		}
+		q.mu.Unlock()
+
+		if err != nil {
+			queueCounts.Add("failed", 1)
+			return
+		}
+		queueCounts.Add("delivered", 1)
+		q.remove(name)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func tempQueue(t *testing.T, maxSize int, maxAge time.Duration) Config {
+	dir, err := ioutil.TempDir("", "nudger-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Config{QueueDir: dir, QueueMaxSize: maxSize, QueueMaxAge: maxAge, RetryMaxBackoff: 10 * time.Millisecond}
+}
+
+func queued(t *testing.T, config Config) int {
+	q, err := OpenQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := q.names()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func receive(t *testing.T, metrics chan Metric) Metric {
+	select {
+	case m := <-metrics:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a metric from the queue, got none")
+	}
+	return Metric{}
+}
+
+// settleAll settles every step of a metric, as Dispatch would.
+func settleAll(m Metric, err error) {
+	for i := m.steps(); i > 0; i-- {
+		m.settle(err)
+	}
+}
+
+func TestQueueReplaysInTimestampOrder(t *testing.T) {
+	config := tempQueue(t, 0, 0)
+	defer os.RemoveAll(config.QueueDir)
+
+	q, err := OpenQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, age := range []int{1, 3, 2} {
+		m := Metric{SPMetricId: fmt.Sprintf("metric-%d", age), Timestamp: now.Add(-time.Duration(age) * time.Minute)}
+		if err := q.Put(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// As if Nudger had restarted.
+	q, err = OpenQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(chan Metric)
+	in := make(chan Metric)
+	q.Start(config, in, metrics)
+	defer func() {
+		close(in)
+		q.Stop()
+	}()
+
+	for _, expected := range []string{"metric-3", "metric-2", "metric-1"} {
+		m := receive(t, metrics)
+		if m.SPMetricId != expected {
+			t.Fatalf("Expected %s, got %s", expected, m.SPMetricId)
+		}
+		if !m.backlog {
+			t.Fatalf("Expected %s to be replayed as backlog", m.SPMetricId)
+		}
+		settleAll(m, nil)
+	}
+	if n := queued(t, config); n != 0 {
+		t.Fatalf("Expected delivered metrics to leave the queue, %d left", n)
+	}
+}
+
+func TestQueueKeepsUndeliveredMetrics(t *testing.T) {
+	config := tempQueue(t, 0, 0)
+	defer os.RemoveAll(config.QueueDir)
+
+	q, err := OpenQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(chan Metric)
+	in := make(chan Metric)
+	q.Start(config, in, metrics)
+	defer func() {
+		close(in)
+		q.Stop()
+	}()
+	if err := q.Put(Metric{SPMetricId: "metric"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := receive(t, metrics)
+	if m.backlog {
+		t.Fatal("Expected a fresh metric not to be backlog")
+	}
+	settleAll(m, &RetryableError{Err: fmt.Errorf("connection refused")})
+	if n := queued(t, config); n != 1 {
+		t.Fatalf("Expected the undelivered metric to stay queued, %d queued", n)
+	}
+
+	m = receive(t, metrics)
+	if !m.backlog {
+		t.Fatal("Expected a retried metric to be backlog")
+	}
+	settleAll(m, &StatusError{Service: "StatusPage", StatusCode: 400})
+	if n := queued(t, config); n != 0 {
+		t.Fatalf("Expected a rejected metric to leave the queue, %d queued", n)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	config := tempQueue(t, 3, time.Hour)
+	defer os.RemoveAll(config.QueueDir)
+
+	q, err := OpenQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, m := range []Metric{
+		{SPMetricId: "expired", Timestamp: now.Add(-2 * time.Hour)},
+		{SPMetricId: "dropped", Timestamp: now.Add(-3 * time.Hour)},
+		{SPMetricId: "old", Timestamp: now.Add(-30 * time.Minute)},
+		{SPMetricId: "new", Timestamp: now},
+	} {
+		if err := q.Put(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := queued(t, config); n != 3 {
+		t.Fatalf("Expected the queue to hold 3 metrics, got %d", n)
+	}
+
+	metrics := make(chan Metric)
+	in := make(chan Metric)
+	q.Start(config, in, metrics)
+	defer func() {
+		close(in)
+		q.Stop()
+	}()
+	for _, expected := range []string{"old", "new"} {
+		m := receive(t, metrics)
+		if m.SPMetricId != expected {
+			t.Fatalf("Expected %s, got %s", expected, m.SPMetricId)
+		}
+		settleAll(m, nil)
+	}
+	if n := queued(t, config); n != 0 {
+		t.Fatalf("Expected the expired metric to be dropped, %d queued", n)
+	}
+}
+
+func TestQueueStopStraightAfterStart(t *testing.T) {
+	config := tempQueue(t, 0, 0)
+	defer os.RemoveAll(config.QueueDir)
+
+	q, err := OpenQueue(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan Metric, 1)
+	in <- Metric{SPMetricId: "metric"}
+	close(in)
+	// Nothing reads from out, so the metric stays queued.
+	q.Start(config, in, make(chan Metric))
+	q.Stop()
+	if n := queued(t, config); n != 1 {
+		t.Fatalf("Expected Stop to wait for the metric to be written, %d queued", n)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	ratelimitCounts  = expvar.NewMap("ratelimit")
+	ratelimitWaiting = new(expvar.Int)
+)
+
+func init() {
+	ratelimitCounts.Set("waiting", ratelimitWaiting)
+}
+
+// TokenBucket allows requests at a steady rate, with bursts of up to burst
+// requests after a quiet spell.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket that refills at rate tokens a second.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Reserve takes a token, and returns how long to wait before using it.
+func (b *TokenBucket) Reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+var limiters = struct {
+	sync.Mutex
+	buckets map[string]*TokenBucket
+}{buckets: make(map[string]*TokenBucket)}
+
+// waitForPage blocks until a request to the StatusPage API for page can be
+// made without going over config.RateLimit. Each page, and API key, has a
+// bucket of its own, so a busy page doesn't hold up the others.
+func waitForPage(config Config, page string, apiKey string) {
+	// Initialise metrics
+	ratelimitCounts.Add("waits", 0)
+	ratelimitCounts.Add("waiting."+page, 0)
+
+	if config.RateLimit <= 0 {
+		return
+	}
+	key := pageKey(Metric{SPPageId: page, SPApiKey: apiKey})
+	limiters.Lock()
+	bucket, ok := limiters.buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(config.RateLimit, config.RateBurst)
+		limiters.buckets[key] = bucket
+	}
+	limiters.Unlock()
+
+	delay := bucket.Reserve()
+	if delay <= 0 {
+		return
+	}
+	ratelimitCounts.Add("waits", 1)
+	ratelimitWaiting.Add(1)
+	ratelimitCounts.Add("waiting."+page, 1)
+	config.sleep(delay)
+	ratelimitCounts.Add("waiting."+page, -1)
+	ratelimitWaiting.Add(-1)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := NewTokenBucket(10, 2)
+
+	// The burst goes straight through...
+	for i := 0; i < 2; i++ {
+		if delay := bucket.Reserve(); delay != 0 {
+			t.Fatalf("Expected request %d to go straight through, got a delay of %s", i, delay)
+		}
+	}
+	// ...and after that, requests are spaced out at the rate.
+	for i, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		delay := bucket.Reserve()
+		if delay < expected-10*time.Millisecond || delay > expected {
+			t.Fatalf("Expected request %d to wait about %s, got %s", i+2, expected, delay)
+		}
+	}
+}
+
+func TestWaitForPageKeepsPagesApart(t *testing.T) {
+	config := Config{RateLimit: 5, RateBurst: 1}
+
+	start := time.Now()
+	waitForPage(config, "busy", "key")
+	waitForPage(config, "quiet", "key")
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("Expected different pages not to wait on each other, took %s", elapsed)
+	}
+
+	waitForPage(config, "busy", "key")
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("Expected a second request to the same page to wait, took %s", elapsed)
+	}
+}
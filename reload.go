@@ -0,0 +1,103 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	configCounts = expvar.NewMap("config")
+	configApps   = new(expvar.Int)
+)
+
+func init() {
+	configCounts.Set("apps", configApps)
+}
+
+// ConfigCheckInterval is how often Watch looks for changes to the config file.
+const ConfigCheckInterval = 5 * time.Second
+
+// Apps holds the apps Nudger polls, so that they can be swapped for a new
+// config while it runs.
+type Apps struct {
+	mu   sync.RWMutex
+	apps []App
+}
+
+func NewApps(apps []App) *Apps {
+	configApps.Set(int64(len(apps)))
+	return &Apps{apps: apps}
+}
+
+// Get returns the current apps.
+func (a *Apps) Get() []App {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.apps
+}
+
+// Reload re-reads the config file. If the new config is invalid, the current
+// apps are kept.
+func (a *Apps) Reload(config Config) error {
+	// Initialise metrics
+	configCounts.Add("reloads", 0)
+	configCounts.Add("errors.reload", 0)
+
+	apps, err := LoadApps(config.ConfigPath)
+	if err != nil {
+		configCounts.Add("errors.reload", 1)
+		return err
+	}
+	a.mu.Lock()
+	a.apps = apps
+	a.mu.Unlock()
+
+	configCounts.Add("reloads", 1)
+	configApps.Set(int64(len(apps)))
+	log.Printf("[info] Reload: Tracking metrics from %d applications", len(apps))
+	return nil
+}
+
+// Watch reloads the config on SIGHUP, or when the file changes.
+func (a *Apps) Watch(config Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	last := configVersion(config.ConfigPath)
+	tick := time.NewTicker(ConfigCheckInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-hup:
+			log.Printf("[info] Reload: SIGHUP received, reloading %s", config.ConfigPath)
+		case <-tick.C:
+			version := configVersion(config.ConfigPath)
+			if version == last {
+				continue
+			}
+			log.Printf("[info] Reload: %s changed, reloading", config.ConfigPath)
+		}
+		// Whether or not the reload works, don't try this version again
+		// until it changes.
+		last = configVersion(config.ConfigPath)
+		if err := a.Reload(config); err != nil {
+			log.Printf("[error] Reload: keeping the current config: %s\n", err)
+		}
+	}
+}
+
+// configVersion returns something that changes whenever the file at path
+// does.
+func configVersion(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", info.ModTime().UnixNano(), info.Size())
+}
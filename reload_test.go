@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestAppsReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "nudger.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	config := Config{ConfigPath: f.Name()}
+
+	write := func(contents string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`[{"nr_app_id": 1, "sp_page_id": "page", "metrics": {"error_rate": "metric"}}]`)
+	loaded, err := LoadApps(config.ConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps := NewApps(loaded)
+
+	write(`[{"nr_app_id": 1, "sp_page_id": "page", "metrics": {"error_rate": "metric"}},
+		{"nr_app_id": 2, "sp_page_id": "page", "metrics": {"throughput": "metric"}}]`)
+	if err := apps.Reload(config); err != nil {
+		t.Fatalf("Expected reload to succeed, got: %s", err)
+	}
+	if n := len(apps.Get()); n != 2 {
+		t.Fatalf("Expected 2 apps after reloading, got %d", n)
+	}
+
+	for _, contents := range []string{
+		`[{"nr_app_id": 1, `,
+		`[{"nr_app_id": 1, "sp_page_id": "page", "metrics": {"bogus": "metric"}}]`,
+	} {
+		write(contents)
+		if err := apps.Reload(config); err == nil {
+			t.Fatalf("Expected reloading %s to fail", contents)
+		}
+		if n := len(apps.Get()); n != 2 {
+			t.Fatalf("Expected the old config to be kept, got %d apps", n)
+		}
+	}
+}
+
+func TestConfigVersion(t *testing.T) {
+	f, err := ioutil.TempFile("", "nudger.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	before := configVersion(f.Name())
+	if err := ioutil.WriteFile(f.Name(), []byte("[]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if configVersion(f.Name()) == before {
+		t.Fatal("Expected the config version to change when the file did")
+	}
+}
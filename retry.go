@@ -0,0 +1,170 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var dispatchCounts = expvar.NewMap("dispatch")
+
+// StatusError is returned by sinks when a request gets an unexpected HTTP
+// status in response.
+type StatusError struct {
+	Service    string
+	StatusCode int
+	Body       string
+	// RetryAfter is how long the service asked us to wait before trying
+	// again, if it said.
+	RetryAfter time.Duration
+}
+
+func NewStatusError(service string, resp *http.Response, body []byte) *StatusError {
+	return &StatusError{
+		Service:    service,
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned HTTP %d: %s", e.Service, e.StatusCode, e.Body)
+}
+
+// Retryable returns whether the request might succeed if sent again.
+func (e *StatusError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// RetryableError wraps failures that might go away if the request is sent
+// again, like a connection being refused.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+// GaveUpError is returned by deliver when a failure that might have been
+// temporary outlasted its retries.
+type GaveUpError struct {
+	Retries int
+	Err     error
+}
+
+func (e *GaveUpError) Error() string {
+	return fmt.Sprintf("giving up after %d retries: %s", e.Retries, e.Err)
+}
+
+// retryable returns whether err is a failure that might go away by itself.
+func retryable(err error) bool {
+	_, ok := retryDelay(err)
+	return ok
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if d := at.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retryDelay returns whether err is worth retrying, and how long the server
+// asked us to wait first, if it did.
+func retryDelay(err error) (time.Duration, bool) {
+	switch e := err.(type) {
+	case *GaveUpError:
+		return retryDelay(e.Err)
+	case *RetryableError:
+		return 0, true
+	case *StatusError:
+		if e.Retryable() {
+			return e.RetryAfter, true
+		}
+	}
+	return 0, false
+}
+
+// backoff returns how long to wait before retry number attempt (from 0): the
+// base backoff doubled each attempt, capped at RetryMaxBackoff unless that's
+// 0, with the top half jittered so that retries from several pollers don't
+// arrive together.
+func backoff(config Config, attempt int) time.Duration {
+	d := config.RetryBackoff
+	for i := 0; i < attempt && d < math.MaxInt64/2; i++ {
+		if config.RetryMaxBackoff > 0 && d >= config.RetryMaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if config.RetryMaxBackoff > 0 && d > config.RetryMaxBackoff {
+		d = config.RetryMaxBackoff
+	}
+	if d/2 <= 0 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// deliver calls publish until it succeeds, or fails in a way that isn't worth
+// retrying, or has been retried config.Retries times. It also gives up if the
+// service asks to be left alone for longer than RetryMaxBackoff, rather than
+// holding on to a worker all that time; the Queue, if there is one, sends the
+// metric again later.
+func deliver(config Config, name string, publish func() error) error {
+	// Initialise metrics
+	dispatchCounts.Add("retries", 0)
+	dispatchCounts.Add("gave_up", 0)
+	dispatchCounts.Add("succeeded_after_retry", 0)
+
+	for attempt := 0; ; attempt++ {
+		err := publish()
+		if err == nil {
+			if attempt > 0 {
+				dispatchCounts.Add("succeeded_after_retry", 1)
+			}
+			return nil
+		}
+
+		after, ok := retryDelay(err)
+		if !ok {
+			return err
+		}
+		if attempt >= config.Retries {
+			if config.Retries > 0 {
+				dispatchCounts.Add("gave_up", 1)
+				return &GaveUpError{Retries: attempt, Err: err}
+			}
+			return err
+		}
+
+		wait := backoff(config, attempt)
+		if after > 0 {
+			if config.RetryMaxBackoff > 0 && after > config.RetryMaxBackoff {
+				dispatchCounts.Add("gave_up", 1)
+				return &GaveUpError{Retries: attempt, Err: err}
+			}
+			wait = after
+		}
+		log.Printf("[info] Dispatch: %s: %s, retrying in %s\n", name, err, wait)
+		dispatchCounts.Add("retries", 1)
+		config.sleep(wait)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// MockFlakyStatusPage fails the first failures requests with status, then
+// accepts everything.
+func MockFlakyStatusPage(failures int32, status int, retryAfter string) (*httptest.Server, *int32) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	return ts, &requests
+}
+
+func TestDeliverRetriesTransientFailures(t *testing.T) {
+	sp, requests := MockFlakyStatusPage(2, http.StatusServiceUnavailable, "")
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1", Retries: 3, RetryBackoff: time.Millisecond, RetryMaxBackoff: 10 * time.Millisecond}
+	metric := Metric{SPPageId: "page", SPMetricId: "metric", Value: 1}
+	err := deliver(config, "statuspage", func() error {
+		return StatusPage{}.Publish(config, SinkConfig{}, metric)
+	})
+	if err != nil {
+		t.Fatalf("Expected delivery to succeed after retrying, got: %s", err)
+	}
+	if *requests != 3 {
+		t.Fatalf("Expected 3 requests, got %d", *requests)
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	sp, requests := MockFlakyStatusPage(10, http.StatusTooManyRequests, "")
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1", Retries: 2, RetryBackoff: time.Millisecond, RetryMaxBackoff: 10 * time.Millisecond}
+	metric := Metric{SPPageId: "page", SPMetricId: "metric", Value: 1}
+	err := deliver(config, "statuspage", func() error {
+		return StatusPage{}.Publish(config, SinkConfig{}, metric)
+	})
+	if err == nil {
+		t.Fatal("Expected delivery to give up, got nil")
+	}
+	if *requests != 3 {
+		t.Fatalf("Expected 3 requests, got %d", *requests)
+	}
+}
+
+func TestDeliverDoesNotRetryClientErrors(t *testing.T) {
+	sp, requests := MockFlakyStatusPage(10, http.StatusUnauthorized, "")
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1", Retries: 3, RetryBackoff: time.Millisecond}
+	metric := Metric{SPPageId: "page", SPMetricId: "metric", Value: 1}
+	deliver(config, "statuspage", func() error {
+		return StatusPage{}.Publish(config, SinkConfig{}, metric)
+	})
+	if *requests != 1 {
+		t.Fatalf("Expected 1 request, got %d", *requests)
+	}
+}
+
+func TestDeliverHonoursRetryAfter(t *testing.T) {
+	sp, _ := MockFlakyStatusPage(1, http.StatusTooManyRequests, "1")
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1", Retries: 1, RetryBackoff: time.Millisecond}
+	metric := Metric{SPPageId: "page", SPMetricId: "metric", Value: 1}
+	start := time.Now()
+	err := deliver(config, "statuspage", func() error {
+		return StatusPage{}.Publish(config, SinkConfig{}, metric)
+	})
+	if err != nil {
+		t.Fatalf("Expected delivery to succeed after retrying, got: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("Expected to wait the 1s StatusPage asked for, waited %s", elapsed)
+	}
+}
+
+func TestDeliverGivesUpOnLongRetryAfter(t *testing.T) {
+	sp, requests := MockFlakyStatusPage(1, http.StatusTooManyRequests, "3600")
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1", Retries: 3, RetryBackoff: time.Millisecond, RetryMaxBackoff: 10 * time.Millisecond}
+	metric := Metric{SPPageId: "page", SPMetricId: "metric", Value: 1}
+	start := time.Now()
+	err := deliver(config, "statuspage", func() error {
+		return StatusPage{}.Publish(config, SinkConfig{}, metric)
+	})
+	if _, ok := err.(*GaveUpError); !ok || !retryable(err) {
+		t.Fatalf("Expected a retryable GaveUpError, got: %v", err)
+	}
+	if *requests != 1 {
+		t.Fatalf("Expected 1 request, got %d", *requests)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected to give up straight away, waited %s", elapsed)
+	}
+}
+
+func TestBackoffUncapped(t *testing.T) {
+	config := Config{RetryBackoff: time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second} {
+		d := backoff(config, attempt)
+		if d < max/2 || d > max {
+			t.Fatalf("Expected attempt %d to back off between %s and %s, got %s", attempt, max/2, max, d)
+		}
+	}
+	if d := backoff(config, 100); d <= 0 {
+		t.Fatalf("Expected a long backoff not to overflow, got %s", d)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	config := Config{RetryBackoff: time.Second, RetryMaxBackoff: 10 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		d := backoff(config, attempt)
+		if d < max/2 || d > max {
+			t.Fatalf("Expected attempt %d to back off between %s and %s, got %s", attempt, max/2, max, d)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Pipeline is what main sets running: the pollers, the queue if there is
+// one, and Dispatch. Shutdown stops them in that order.
+type Pipeline struct {
+	Polls sync.WaitGroup
+	// Polled is where pollers send metrics: Metrics itself, or the queue.
+	Polled  chan Metric
+	Queue   *Queue
+	Metrics chan Metric
+	// Dispatched is closed once Dispatch has returned.
+	Dispatched chan struct{}
+	Server     *http.Server
+}
+
+// Shutdown waits for polls in progress to finish, and for Dispatch to deliver
+// the metrics they fetched, giving up after config.ShutdownTimeout. It then
+// stops the instrumentation server, and returns whether everything was
+// delivered.
+func Shutdown(config Config, p *Pipeline) bool {
+	start := time.Now()
+	deadline := time.After(config.ShutdownTimeout)
+	drained := wait(&p.Polls, deadline)
+	if !drained {
+		log.Printf("[error] Shutdown: polls still running after %s\n", config.ShutdownTimeout)
+	} else {
+		if p.Queue != nil {
+			close(p.Polled)
+			p.Queue.Stop()
+		}
+		close(p.Metrics)
+		select {
+		case <-p.Dispatched:
+		case <-deadline:
+			drained = false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Server.Shutdown(ctx); err != nil {
+		log.Printf("[error] Shutdown: instrumentation: %s\n", err)
+	}
+
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if drained {
+		log.Printf("[info] Shutdown: everything delivered, took %s", elapsed)
+		return true
+	}
+	log.Printf("[error] Shutdown: gave up after %s with %d submissions undelivered\n", elapsed, poolPending.Value())
+	if p.Queue != nil {
+		log.Printf("[info] Shutdown: undelivered metrics are queued in %s for next time", config.QueueDir)
+	}
+	return false
+}
+
+// wait waits for wg, until deadline, and returns whether it finished.
+func wait(wg *sync.WaitGroup, deadline <-chan time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
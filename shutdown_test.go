@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startPipeline(config Config, apps []App) *Pipeline {
+	p := &Pipeline{
+		Metrics:    make(chan Metric),
+		Dispatched: make(chan struct{}),
+		Server:     &http.Server{},
+	}
+	p.Polled = p.Metrics
+	go func() {
+		Dispatch(config, p.Metrics)
+		close(p.Dispatched)
+	}()
+	Poll(config, apps, p.Polled, &p.Polls)
+	return p
+}
+
+func TestShutdownDrainsMetrics(t *testing.T) {
+	Sources["mock"] = MockSource{Metrics: []Metric{{Key: "a", SPPageId: "page", SPMetricId: "a", Value: 1}}}
+	defer delete(Sources, "mock")
+
+	sp, requests := MockFlakyStatusPage(0, 0, "")
+	defer sp.Close()
+
+	// The batch window is far longer than the test, so the metric is only
+	// sent if shutting down flushes it.
+	config := Config{SPBaseURL: sp.URL + "/v1", BatchWindow: time.Hour, ShutdownTimeout: 5 * time.Second}
+	p := startPipeline(config, []App{{Source: "mock", SPPageId: "page"}})
+
+	if !Shutdown(config, p) {
+		t.Fatal("Expected shutdown to deliver everything")
+	}
+	if *requests != 1 {
+		t.Fatalf("Expected the batched metric to be sent on shutdown, got %d requests", *requests)
+	}
+}
+
+func TestShutdownGivesUp(t *testing.T) {
+	Sources["mock"] = MockSource{Metrics: []Metric{{Key: "a", SPPageId: "page", SPMetricId: "a", Value: 1}}}
+	defer delete(Sources, "mock")
+
+	release := make(chan struct{})
+	sp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer sp.Close()
+	defer close(release)
+
+	config := Config{SPBaseURL: sp.URL + "/v1", ShutdownTimeout: 100 * time.Millisecond}
+	p := startPipeline(config, []App{{Source: "mock", SPPageId: "page"}})
+
+	start := time.Now()
+	if Shutdown(config, p) {
+		t.Fatal("Expected shutdown to give up on a hung StatusPage")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected shutdown to give up after its timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// A Sink publishes metrics somewhere people can see them.
+type Sink interface {
+	// Validate checks that the sink's config, and the app it belongs to, are
+	// usable by the sink.
+	Validate(target SinkConfig, app App) error
+	// Publish sends a single metric to the sink.
+	Publish(config Config, target SinkConfig, metric Metric) error
+}
+
+// A BatchSink can also publish several metrics in one request. Dispatch
+// batches metrics for these sinks when Config.BatchWindow is set.
+type BatchSink interface {
+	Sink
+	// PublishBatch sends metrics that share a batch key in one go. If only
+	// some of them get through, it returns a BatchError.
+	PublishBatch(config Config, target SinkConfig, metrics []Metric) error
+}
+
+// BatchError is returned by PublishBatch when some of a batch's metrics were
+// published and others weren't. Errs holds the error for each metric, in the
+// order they were passed in, with nil for those that were published.
+type BatchError struct {
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	var failed int
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d metrics failed, first: %s", failed, len(e.Errs), first)
+}
+
+// metricErr returns the error for the i'th metric of a batch that failed
+// with err.
+func metricErr(err error, i int) error {
+	if e, ok := err.(*BatchError); ok && i < len(e.Errs) {
+		return e.Errs[i]
+	}
+	return err
+}
+
+// Sinks maps the "type" of an app's sink config to its implementation.
+var Sinks = map[string]Sink{
+	"statuspage": StatusPage{},
+	"webhook":    Webhook{},
+}
+
+// SinkConfig is an entry in an app's "sinks" config. Apps without any sinks
+// publish to StatusPage.
+type SinkConfig struct {
+	Type    string            `json:"type"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+var DefaultSinks = []SinkConfig{{Type: "statuspage"}}
+
+// SinkConfigs returns the sinks the app's metrics are published to.
+func (app App) SinkConfigs() []SinkConfig {
+	if len(app.Sinks) == 0 {
+		return DefaultSinks
+	}
+	return app.Sinks
+}
+
+func validateSinks(app App) error {
+	for i, target := range app.SinkConfigs() {
+		sink, ok := Sinks[target.Type]
+		if !ok {
+			return configError(fmt.Sprintf("sinks[%d]", i), "unknown sink %q", target.Type)
+		}
+		if err := sink.Validate(target, app); err != nil {
+			return configError(fmt.Sprintf("sinks[%d]", i), "%s", err)
+		}
+	}
+	return nil
+}
+
+// targets returns the sinks the metric is published to.
+func (m Metric) targets() []SinkConfig {
+	if len(m.Sinks) == 0 {
+		return DefaultSinks
+	}
+	return m.Sinks
+}
+
+// batchKey identifies the metrics that can be sent to a sink in the same
+// batch: those for the same page, with the same credentials.
+func batchKey(target SinkConfig, metric Metric) string {
+	return strings.Join([]string{target.Type, target.URL, metric.SPPageId, metric.SPApiKey}, "\x00")
+}
+
+type batch struct {
+	target  SinkConfig
+	metrics []Metric
+}
+
+// Batcher holds metrics for BatchSinks until Dispatch flushes them.
+type Batcher struct {
+	batches map[string]*batch
+}
+
+func NewBatcher() *Batcher {
+	return &Batcher{batches: make(map[string]*batch)}
+}
+
+// Add holds a metric until the next Flush.
+func (b *Batcher) Add(target SinkConfig, metric Metric) {
+	key := batchKey(target, metric)
+	if b.batches[key] == nil {
+		b.batches[key] = &batch{target: target}
+	}
+	b.batches[key].metrics = append(b.batches[key].metrics, metric)
+}
+
+// Len returns how many metrics are waiting to be flushed.
+func (b *Batcher) Len() int {
+	var n int
+	for _, batch := range b.batches {
+		n += len(batch.metrics)
+	}
+	return n
+}
+
+// Flush hands every batch that has built up to pool to publish, and starts
+// afresh.
+func (b *Batcher) Flush(config Config, pool *Pool) {
+	keys := make([]string, 0, len(b.batches))
+	for key := range b.batches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		batch := b.batches[key]
+		sink := Sinks[batch.target.Type].(BatchSink)
+		if config.Debug {
+			log.Printf("[debug] Dispatch: flushing %d metrics to %s\n", len(batch.metrics), batch.target.Type)
+		}
+		pool.Submit(key, func() {
+			err := deliver(config, batch.target.Type, func() error {
+				return sink.PublishBatch(config, batch.target, batch.metrics)
+			})
+			if err != nil {
+				log.Printf("[error] Dispatch: %s: %s\n", batch.target.Type, err)
+			}
+			for i, m := range batch.metrics {
+				recordSubmission(batch.target, m, metricErr(err, i))
+				m.settle(metricErr(err, i))
+			}
+		})
+	}
+	b.batches = make(map[string]*batch)
+}
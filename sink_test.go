@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func MockWebhook(requests chan WebhookPayload) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p WebhookPayload
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &p)
+		requests <- p
+	}))
+	return ts
+}
+
+func TestDispatchFansOutToSinks(t *testing.T) {
+	spRequests := make(chan string, 1)
+	sp := MockStatusPage(spRequests)
+	defer sp.Close()
+	whRequests := make(chan WebhookPayload, 1)
+	wh := MockWebhook(whRequests)
+	defer wh.Close()
+
+	config := Config{
+		SPBaseURL: sp.URL + "/v1",
+	}
+	metrics := make(chan Metric)
+	go Dispatch(config, metrics)
+
+	metrics <- Metric{
+		Key:        "response_time",
+		SPPageId:   "world",
+		SPMetricId: "true",
+		Value:      10.123,
+		Sinks:      []SinkConfig{{Type: "statuspage"}, {Type: "webhook", URL: wh.URL}},
+	}
+
+	select {
+	case <-spRequests:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Expected dispatch to StatusPage, got nothing after 1 second.")
+	}
+	select {
+	case p := <-whRequests:
+		if p.Key != "response_time" || p.Value != 10.123 {
+			t.Fatalf("Expected the dispatched metric on the webhook, got: %+v", p)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Expected dispatch to webhook, got nothing after 1 second.")
+	}
+}
+
+func TestAppValidateSinks(t *testing.T) {
+	app := App{SPPageId: "page", Sinks: []SinkConfig{{Type: "statuspage"}, {Type: "webhook", URL: "http://localhost/"}}}
+	if err := app.Validate(); err != nil {
+		t.Fatalf("Expected sinks to be valid, got: %s", err)
+	}
+
+	app.Sinks = []SinkConfig{{Type: "webhook"}}
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for a webhook without a url, got nil")
+	}
+
+	app.Sinks = []SinkConfig{{Type: "graphite"}}
+	if err := app.Validate(); err == nil {
+		t.Fatal("Expected an error for unknown sink 'graphite', got nil")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// A Source fetches samples for a configured app from a monitoring system.
+type Source interface {
+	// Validate checks that the app's config is usable by the source.
+	Validate(app App) error
+	// Fetch returns the app's current metrics, ready to be dispatched.
+	Fetch(config Config, app App) ([]Metric, error)
+}
+
+// Sources maps the "source" field of an app's config to its implementation.
+// Apps without a source are polled from New Relic.
+var Sources = map[string]Source{
+	"newrelic":   NewRelic{},
+	"prometheus": Prometheus{},
+	"httpjson":   HTTPJSON{},
+	"insights":   Insights{},
+	"nerdgraph":  NerdGraph{},
+}
+
+const DefaultSource = "newrelic"
+
+// SourceName returns the name of the source the app is polled from.
+func (app App) SourceName() string {
+	if app.Source == "" {
+		return DefaultSource
+	}
+	return app.Source
+}
+
+// Name identifies the app in logs and instrumentation: by its New Relic app id
+// where it has one, or otherwise by where its source fetches from.
+func (app App) Name() string {
+	switch {
+	case app.NRAppId != 0:
+		return strconv.Itoa(app.NRAppId)
+	case app.NREntityGuid != "":
+		return app.NREntityGuid
+	case app.PrometheusURL != "":
+		return app.PrometheusURL
+	case app.URL != "":
+		return app.URL
+	case app.NRAccountId != 0:
+		return "account " + strconv.Itoa(app.NRAccountId)
+	}
+	return app.SourceName()
+}
+
+// Validate checks that the app names a known source and known sinks, and that
+// they, and its component and incident rules, are happy with the rest of its config.
+func (app App) Validate() error {
+	source, ok := Sources[app.SourceName()]
+	if !ok {
+		return configError("source", "unknown source %q", app.Source)
+	}
+	if err := source.Validate(app); err != nil {
+		return err
+	}
+	if err := validateComponents(app); err != nil {
+		return err
+	}
+	if err := validateIncidents(app); err != nil {
+		return err
+	}
+	if err := validateStaleness(app); err != nil {
+		return err
+	}
+	return validateSinks(app)
+}
+
+// PollApp fetches an app's metrics from the source it is configured with.
+func PollApp(config Config, app App, metrics chan Metric) {
+	source, ok := Sources[app.SourceName()]
+	if !ok {
+		log.Printf("[error] Poll: unknown source %q\n", app.Source)
+		return
+	}
+	PollSource(config, source, app, metrics)
+}
+
+// PollSource fetches an app's metrics from a source and sends them on.
+func PollSource(config Config, source Source, app App, metrics chan Metric) {
+	samples, err := source.Fetch(config, app)
+	// Sources skip the metrics they can't fetch, so getting none at all
+	// means the source is as good as down.
+	if err == nil && len(samples) == 0 && len(app.SPMetrics) > 0 {
+		err = fmt.Errorf("none of %d metrics could be fetched", len(app.SPMetrics))
+	}
+	if err != nil {
+		log.Printf("[error] Poll: %s: %s\n", app.SourceName(), err)
+		pollErrors.Add(1, app.Name(), app.SourceName())
+		statuses.Polled(app, err)
+		return
+	}
+	statuses.Polled(app, nil)
+	health.Polled()
+	for i := range samples {
+		samples[i].App = app.Name()
+		samples[i].Components = app.componentRulesFor(samples[i].Key)
+	}
+	// Component rules go on before the watchdog, which may add one of its
+	// own.
+	samples = watchdog.Check(app, samples)
+	for _, m := range samples {
+		m.Sinks = app.SinkConfigs()
+		m.Incidents = app.incidentRulesFor(m.Key)
+		fetchedCounts.Add(1, m.App, m.Key)
+		statuses.Fetched(m)
+		metrics <- m
+	}
+}
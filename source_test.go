@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type MockSource struct {
+	Metrics []Metric
+	Err     error
+}
+
+func (s MockSource) Validate(app App) error {
+	return nil
+}
+
+func (s MockSource) Fetch(config Config, app App) ([]Metric, error) {
+	return s.Metrics, s.Err
+}
+
+func TestPollAppDispatchesToSource(t *testing.T) {
+	Sources["mock"] = MockSource{Metrics: []Metric{{SPMetricId: "mock", Value: 42}}}
+	defer delete(Sources, "mock")
+
+	metrics := make(chan Metric)
+	go PollApp(Config{}, App{Source: "mock"}, metrics)
+
+	select {
+	case m := <-metrics:
+		if m.SPMetricId != "mock" || m.Value != 42 {
+			t.Fatalf("Expected the mock source's metric, got: %+v", m)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("Expected a metric from the mock source, got nothing after 1 second.")
+	}
+}
+
+func TestPollSourceDropsFailedFetch(t *testing.T) {
+	metrics := make(chan Metric, 1)
+	source := MockSource{Metrics: []Metric{{SPMetricId: "mock"}}, Err: errors.New("boom")}
+	PollSource(Config{}, source, App{Source: "mock"}, metrics)
+
+	if len(metrics) != 0 {
+		t.Fatalf("Expected no metrics from a failed fetch, got %d", len(metrics))
+	}
+}
+
+func TestAppValidateUnknownSource(t *testing.T) {
+	if err := (App{SPPageId: "page"}).Validate(); err != nil {
+		t.Fatalf("Expected an app without a source to be valid, got: %s", err)
+	}
+	if err := (App{Source: "nagios", SPPageId: "page"}).Validate(); err == nil {
+		t.Fatal("Expected an error for unknown source 'nagios', got nil")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AppStatus is how polling an app, and delivering its metrics, has gone.
+type AppStatus struct {
+	Name        string                   `json:"name"`
+	Source      string                   `json:"source"`
+	Polls       int64                    `json:"polls"`
+	PollErrors  int64                    `json:"poll_errors"`
+	LastSuccess time.Time                `json:"last_success"`
+	LastFailure time.Time                `json:"last_failure"`
+	LastError   string                   `json:"last_error,omitempty"`
+	Metrics     map[string]*MetricStatus `json:"metrics"`
+}
+
+// MetricStatus is how fetching and delivering one of an app's metrics has
+// gone. Metrics are told apart by their StatusPage metric id, or by key
+// where they don't have one.
+type MetricStatus struct {
+	Key              string    `json:"key"`
+	SPPageId         string    `json:"sp_page_id"`
+	SPMetricId       string    `json:"sp_metric_id"`
+	Fetches          int64     `json:"fetches"`
+	LastFetched      time.Time `json:"last_fetched"`
+	LastValue        float64   `json:"last_value"`
+	Submissions      int64     `json:"submissions"`
+	SubmissionErrors int64     `json:"submission_errors"`
+	LastSuccess      time.Time `json:"last_success"`
+	LastFailure      time.Time `json:"last_failure"`
+	LastError        string    `json:"last_error,omitempty"`
+}
+
+// Statuses tracks the status of every app, by name.
+type Statuses struct {
+	mu   sync.Mutex
+	apps map[string]*AppStatus
+}
+
+func NewStatuses() *Statuses {
+	return &Statuses{apps: make(map[string]*AppStatus)}
+}
+
+// statuses is published in expvar as "apps", and served at /status.
+var statuses = NewStatuses()
+
+func init() {
+	expvar.Publish("apps", expvar.Func(func() interface{} { return statuses.Snapshot() }))
+	http.HandleFunc("/status", ServeStatus)
+}
+
+func (s *Statuses) app(name string, source string) *AppStatus {
+	a, ok := s.apps[name]
+	if !ok {
+		a = &AppStatus{Name: name, Source: source, Metrics: make(map[string]*MetricStatus)}
+		s.apps[name] = a
+	}
+	return a
+}
+
+func (s *Statuses) metric(m Metric) *MetricStatus {
+	a := s.app(m.App, "")
+	id := m.SPMetricId
+	if id == "" {
+		id = m.Key
+	}
+	ms, ok := a.Metrics[id]
+	if !ok {
+		ms = &MetricStatus{Key: m.Key, SPPageId: m.SPPageId, SPMetricId: m.SPMetricId}
+		a.Metrics[id] = ms
+	}
+	return ms
+}
+
+// Polled records how polling an app went.
+func (s *Statuses) Polled(app App, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.app(app.Name(), app.SourceName())
+	a.Source = app.SourceName()
+	a.Polls++
+	if err != nil {
+		a.PollErrors++
+		a.LastFailure = time.Now()
+		a.LastError = err.Error()
+		return
+	}
+	a.LastSuccess = time.Now()
+}
+
+// Fetched records a metric fetched from its app's source.
+func (s *Statuses) Fetched(m Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := s.metric(m)
+	ms.Fetches++
+	ms.LastFetched = time.Now()
+	ms.LastValue = m.Value
+}
+
+// Submitted records how submitting a metric to a sink went.
+func (s *Statuses) Submitted(m Metric, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := s.metric(m)
+	ms.Submissions++
+	if err != nil {
+		ms.SubmissionErrors++
+		ms.LastFailure = time.Now()
+		ms.LastError = err.Error()
+		return
+	}
+	ms.LastSuccess = time.Now()
+}
+
+// Snapshot returns a copy of every app's status.
+func (s *Statuses) Snapshot() map[string]AppStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make(map[string]AppStatus, len(s.apps))
+	for name, a := range s.apps {
+		app := *a
+		app.Metrics = make(map[string]*MetricStatus, len(a.Metrics))
+		for id, m := range a.Metrics {
+			copied := *m
+			app.Metrics[id] = &copied
+		}
+		snapshot[name] = app
+	}
+	return snapshot
+}
+
+// ServeStatus serves every app's status as JSON. ?app= narrows it down to
+// one app.
+func ServeStatus(w http.ResponseWriter, r *http.Request) {
+	snapshot := statuses.Snapshot()
+	var v interface{} = snapshot
+	if name := r.URL.Query().Get("app"); name != "" {
+		app, ok := snapshot[name]
+		if !ok {
+			http.Error(w, "unknown app", http.StatusNotFound)
+			return
+		}
+		v = app
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// freshStatuses swaps the global statuses for empty ones, and returns a
+// func that puts the old ones back, so that tests can count from zero.
+func freshStatuses() func() {
+	old := statuses
+	statuses = NewStatuses()
+	return func() { statuses = old }
+}
+
+// lastPolled returns when health last saw a successful poll.
+func lastPolled() time.Time {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	return health.polled
+}
+
+func TestStatuses(t *testing.T) {
+	defer freshStatuses()()
+	app := App{Source: "mock", NRAppId: 424242, SPPageId: "page"}
+	metrics := make(chan Metric, 1)
+	PollSource(Config{}, MockSource{Err: errors.New("401 Unauthorized")}, app, metrics)
+	PollSource(Config{}, MockSource{Metrics: []Metric{{Key: "error_rate", SPPageId: "page", SPMetricId: "metric", Value: 0.5}}}, app, metrics)
+	m := <-metrics
+	recordSubmission(SinkConfig{Type: "statuspage"}, m, errors.New("StatusPage returned 500"))
+	recordSubmission(SinkConfig{Type: "statuspage"}, m, nil)
+
+	status, ok := statuses.Snapshot()["424242"]
+	if !ok {
+		t.Fatal("Expected a status for app 424242")
+	}
+	if status.Polls != 2 || status.PollErrors != 1 || status.LastError != "401 Unauthorized" {
+		t.Fatalf("Expected 2 polls, 1 failing with 401 Unauthorized, got %+v", status)
+	}
+	if status.LastSuccess.IsZero() || status.LastFailure.IsZero() {
+		t.Fatalf("Expected the last success and failure to be recorded, got %+v", status)
+	}
+	ms, ok := status.Metrics["metric"]
+	if !ok {
+		t.Fatalf("Expected a status for metric id 'metric', got %+v", status.Metrics)
+	}
+	if ms.Fetches != 1 || ms.LastValue != 0.5 || ms.Submissions != 2 || ms.SubmissionErrors != 1 {
+		t.Fatalf("Expected 1 fetch and 2 submissions, 1 failing, got %+v", ms)
+	}
+	if ms.LastSuccess.IsZero() || ms.LastFailure.IsZero() || ms.LastError != "StatusPage returned 500" {
+		t.Fatalf("Expected the last success and failure to be recorded, got %+v", ms)
+	}
+}
+
+func TestStatusesEmptyPoll(t *testing.T) {
+	defer freshStatuses()()
+	app := App{Source: "mock", NRAppId: 444444, SPPageId: "page", SPMetrics: map[string]MetricConfig{"error_rate": {SPMetricId: "metric"}}}
+	metrics := make(chan Metric, 1)
+	polled := lastPolled()
+	PollSource(Config{}, MockSource{}, app, metrics)
+
+	status := statuses.Snapshot()["444444"]
+	if status.PollErrors != 1 || !status.LastSuccess.IsZero() || status.LastError != "none of 1 metrics could be fetched" {
+		t.Fatalf("Expected a poll that fetched nothing to count as failed, got %+v", status)
+	}
+	if !lastPolled().Equal(polled) {
+		t.Fatal("Expected a poll that fetched nothing not to count towards /readyz")
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	defer freshStatuses()()
+	statuses.Polled(App{Source: "mock", NRAppId: 434343}, nil)
+
+	rec := httptest.NewRecorder()
+	ServeStatus(rec, httptest.NewRequest("GET", "/status?app=434343", nil))
+	var status AppStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Expected JSON, got %q: %s", rec.Body.String(), err)
+	}
+	if status.Name != "434343" || status.Source != "mock" || status.Polls != 1 {
+		t.Fatalf("Expected the status of app 434343, got %+v", status)
+	}
+
+	rec = httptest.NewRecorder()
+	ServeStatus(rec, httptest.NewRequest("GET", "/status?app=nope", nil))
+	if rec.Code != 404 {
+		t.Fatalf("Expected 404 for an unknown app, got %d", rec.Code)
+	}
+}
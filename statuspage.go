@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var statuspageCounts = expvar.NewMap("statuspage")
+
+type SPData struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type SPPayload struct {
+	Data SPData `json:"data"`
+}
+
+// SPBulkPayload is what the page-level metrics/data.json endpoint takes: data
+// points for any number of the page's metrics, by metric id.
+type SPBulkPayload struct {
+	Data map[string][]SPData `json:"data"`
+}
+
+// StatusPage is the Sink that submits metric data points to a StatusPage page.
+type StatusPage struct{}
+
+// Validate checks that the app says which page to publish to.
+func (StatusPage) Validate(target SinkConfig, app App) error {
+	if app.SPPageId == "" {
+		return fmt.Errorf("statuspage sink: missing sp_page_id")
+	}
+	return nil
+}
+
+func (StatusPage) Publish(config Config, target SinkConfig, metric Metric) error {
+	// Initialise metrics
+	statuspageCounts.Add("errors.json.marshal", 0)
+	statuspageCounts.Add("errors.http.new", 0)
+	statuspageCounts.Add("errors.http.do", 0)
+	statuspageCounts.Add("errors.http.readbody", 0)
+	statuspageCounts.Add("errors.http.status", 0)
+	statuspageCounts.Add("requests", 0)
+
+	parts := []string{config.SPBaseURL, "pages", metric.SPPageId, "metrics", metric.SPMetricId, "data.json"}
+	url := strings.Join(parts, "/")
+	if config.Debug {
+		log.Printf("[debug] Dispatch: URL: %s", url)
+	}
+
+	payload := SPPayload{
+		Data: SPData{
+			Timestamp: metric.Time().Unix(),
+			Value:     metric.Value,
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		statuspageCounts.Add("errors.json.marshal", 1)
+		return fmt.Errorf("JSON marshal: %s", err)
+	}
+	if config.Debug {
+		log.Printf("[debug] Dispatch: JSON marshal: %s", string(body))
+	}
+
+	client := config.HTTPClient()
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		statuspageCounts.Add("errors.http.new", 1)
+		return fmt.Errorf("new request: %s", err)
+	}
+	req.Header.Set("Authorization", "OAuth "+metric.SPApiKey)
+
+	waitForPage(config, metric.SPPageId, metric.SPApiKey)
+	start := time.Now()
+	resp, err := client.Do(req)
+	requestLatency.Since(start, "statuspage")
+	if err != nil {
+		statuspageCounts.Add("errors.http.do", 1)
+		return &RetryableError{Err: fmt.Errorf("client do: %s", err)}
+	}
+	defer resp.Body.Close()
+	statuspageCounts.Add("requests", 1)
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		statuspageCounts.Add("errors.http.readbody", 1)
+		return fmt.Errorf("couldn't read body: %s", err)
+	}
+
+	if resp.StatusCode != 201 {
+		statuspageCounts.Add("errors.http.status", 1)
+		return NewStatusError("StatusPage", resp, body)
+	}
+	return nil
+}
+
+// PublishBatch submits data points for several of a page's metrics in one
+// request, through the page-level bulk endpoint. If StatusPage rejects the
+// bulk request outright, each metric is sent on its own instead, and a
+// BatchError says which of them failed.
+func (sp StatusPage) PublishBatch(config Config, target SinkConfig, metrics []Metric) error {
+	// Initialise metrics
+	statuspageCounts.Add("bulk.metrics", 0)
+	statuspageCounts.Add("bulk.fallbacks", 0)
+
+	if len(metrics) == 0 {
+		return nil
+	}
+	page := metrics[0].SPPageId
+	payload := SPBulkPayload{Data: make(map[string][]SPData)}
+	for _, m := range metrics {
+		point := SPData{Timestamp: m.Time().Unix(), Value: m.Value}
+		payload.Data[m.SPMetricId] = append(payload.Data[m.SPMetricId], point)
+	}
+
+	parts := []string{config.SPBaseURL, "pages", page, "metrics", "data.json"}
+	url := strings.Join(parts, "/")
+	err := spRequest(config, "bulk.", "POST", url, page, metrics[0].SPApiKey, payload, nil)
+	if err == nil {
+		statuspageCounts.Add("bulk.metrics", int64(len(metrics)))
+		return nil
+	}
+	if !bulkUnsupported(err) {
+		return err
+	}
+
+	log.Printf("[info] Dispatch: bulk submission to page %s failed, sending %d metrics one at a time: %s\n", page, len(metrics), err)
+	statuspageCounts.Add("bulk.fallbacks", 1)
+	var failed int
+	errs := make([]error, len(metrics))
+	for i, m := range metrics {
+		if errs[i] = sp.Publish(config, target, m); errs[i] != nil {
+			log.Printf("[error] Dispatch: statuspage: %s\n", errs[i])
+			failed++
+		}
+	}
+	if failed > 0 {
+		return &BatchError{Errs: errs}
+	}
+	return nil
+}
+
+// bulkUnsupported returns whether StatusPage turned down a bulk request in a
+// way that sending the same metrics one at a time might get around. Failures
+// that would affect every request, like a bad API key, don't count.
+func bulkUnsupported(err error) bool {
+	status, ok := err.(*StatusError)
+	if !ok {
+		return false
+	}
+	switch status.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusRequestEntityTooLarge, 422:
+		return true
+	}
+	return false
+}
+
+// spRequest sends payload to the StatusPage API on behalf of page, and decodes
+// the response into v, if given. Requests and failures are counted under
+// prefix, e.g. "components.".
+func spRequest(config Config, prefix string, method string, url string, page string, apiKey string, payload interface{}, v interface{}) error {
+	// Initialise metrics
+	statuspageCounts.Add(prefix+"errors.json.marshal", 0)
+	statuspageCounts.Add(prefix+"errors.json.decode", 0)
+	statuspageCounts.Add(prefix+"errors.http.new", 0)
+	statuspageCounts.Add(prefix+"errors.http.do", 0)
+	statuspageCounts.Add(prefix+"errors.http.readbody", 0)
+	statuspageCounts.Add(prefix+"errors.http.status", 0)
+	statuspageCounts.Add(prefix+"requests", 0)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		statuspageCounts.Add(prefix+"errors.json.marshal", 1)
+		return fmt.Errorf("JSON marshal: %s", err)
+	}
+	if config.Debug {
+		log.Printf("[debug] Dispatch: %s %s: %s", method, url, string(body))
+	}
+
+	client := config.HTTPClient()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		statuspageCounts.Add(prefix+"errors.http.new", 1)
+		return fmt.Errorf("new request: %s", err)
+	}
+	req.Header.Set("Authorization", "OAuth "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	waitForPage(config, page, apiKey)
+	start := time.Now()
+	resp, err := client.Do(req)
+	requestLatency.Since(start, "statuspage")
+	if err != nil {
+		statuspageCounts.Add(prefix+"errors.http.do", 1)
+		return &RetryableError{Err: fmt.Errorf("client do: %s", err)}
+	}
+	defer resp.Body.Close()
+	statuspageCounts.Add(prefix+"requests", 1)
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		statuspageCounts.Add(prefix+"errors.http.readbody", 1)
+		return fmt.Errorf("couldn't read body: %s", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		statuspageCounts.Add(prefix+"errors.http.status", 1)
+		return NewStatusError("StatusPage", resp, body)
+	}
+
+	if v != nil {
+		if err := json.Unmarshal(body, v); err != nil {
+			statuspageCounts.Add(prefix+"errors.json.decode", 1)
+			return fmt.Errorf("couldn't decode json: %s, raw body: %s", err, body)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStatusPageUsesObservedTimestamp(t *testing.T) {
+	payloads := make(chan SPPayload, 1)
+	sp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p SPPayload
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &p)
+		payloads <- p
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+	// Past 2038, to make sure the timestamp isn't truncated to 32 bits.
+	observed := time.Date(2040, 1, 2, 3, 4, 5, 0, time.UTC)
+	metric := Metric{SPPageId: "page", SPMetricId: "metric", Value: 1, Timestamp: observed}
+	if err := (StatusPage{}).Publish(config, SinkConfig{}, metric); err != nil {
+		t.Fatalf("Expected no error, got: %s", err)
+	}
+
+	p := <-payloads
+	if p.Data.Timestamp != observed.Unix() {
+		t.Fatalf("Expected timestamp %d, got %d", observed.Unix(), p.Data.Timestamp)
+	}
+}
+
+func TestDispatchBatchesPerPage(t *testing.T) {
+	requests := make(chan string, 10)
+	sp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p SPBulkPayload
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &p)
+		requests <- r.URL.Path + " " + strconv.Itoa(len(p.Data))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1", BatchWindow: 100 * time.Millisecond}
+	metrics := make(chan Metric)
+	go Dispatch(config, metrics)
+
+	metrics <- Metric{SPPageId: "one", SPMetricId: "a", Value: 1}
+	metrics <- Metric{SPPageId: "two", SPMetricId: "c", Value: 3}
+	metrics <- Metric{SPPageId: "one", SPMetricId: "b", Value: 2}
+
+	received := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case request := <-requests:
+			received[request] = true
+		case <-time.After(1 * time.Second):
+			t.Fatal("Expected a bulk submission per page, got nothing after 1 second.")
+		}
+	}
+	if !received["/v1/pages/one/metrics/data.json 2"] || !received["/v1/pages/two/metrics/data.json 1"] {
+		t.Fatalf("Expected one bulk submission per page, got: %v", received)
+	}
+}
+
+func TestStatusPageBulkFallback(t *testing.T) {
+	requests := make(chan string, 10)
+	sp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path
+		if r.URL.Path == "/v1/pages/page/metrics/data.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+	metrics := []Metric{{SPPageId: "page", SPMetricId: "a", Value: 1}, {SPPageId: "page", SPMetricId: "b", Value: 2}}
+	if err := (StatusPage{}).PublishBatch(config, SinkConfig{}, metrics); err != nil {
+		t.Fatalf("Expected the fallback to succeed, got: %s", err)
+	}
+
+	expected := []string{"/v1/pages/page/metrics/data.json", "/v1/pages/page/metrics/a/data.json", "/v1/pages/page/metrics/b/data.json"}
+	for _, path := range expected {
+		if request := <-requests; request != path {
+			t.Fatalf("Expected a request to %s, got %s", path, request)
+		}
+	}
+}
+
+func TestStatusPageBulkFallbackPartialFailure(t *testing.T) {
+	sp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/pages/page/metrics/data.json":
+			w.WriteHeader(http.StatusNotFound)
+		case "/v1/pages/page/metrics/b/data.json":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1", Workers: 1}
+	settled := make(chan string, 2)
+	batcher := NewBatcher()
+	for _, id := range []string{"a", "b"} {
+		id := id
+		m := Metric{SPPageId: "page", SPMetricId: id, Value: 1}
+		m.delivery = &delivery{remaining: 1, done: func(err error) {
+			settled <- fmt.Sprintf("%s %v", id, err != nil)
+		}}
+		batcher.Add(SinkConfig{Type: "statuspage"}, m)
+	}
+	pool := NewPool(1)
+	batcher.Flush(config, pool)
+	pool.Close()
+
+	results := map[string]bool{<-settled: true, <-settled: true}
+	if !results["a false"] || !results["b true"] {
+		t.Fatalf("Expected only b to fail, got: %v", results)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Exit codes for `nudger validate`.
+const (
+	ValidateOK       = 0
+	ValidateProblems = 1
+	ValidateUnusable = 2
+)
+
+// spPageId matches the ids StatusPage gives pages.
+var spPageId = regexp.MustCompile(`^[a-z0-9]{12}$`)
+
+// Problem is something wrong with the config, found by ValidateConfig.
+type Problem struct {
+	// App is the index of the app in the config, or -1 for the file as a
+	// whole.
+	App     int
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.App < 0 {
+		return p.Message
+	}
+	path := fmt.Sprintf("$[%d]", p.App)
+	if p.Path != "" {
+		path += "." + p.Path
+	}
+	return fmt.Sprintf("%s: %s", path, p.Message)
+}
+
+// ConfigError is what App.Validate returns for a problem with an app's
+// config, so that ValidateConfig can say where in the app it is.
+type ConfigError struct {
+	// Path is where the problem is in the app, e.g. "components[0]".
+	Path    string
+	Message string
+}
+
+func configError(path string, format string, args ...interface{}) error {
+	return &ConfigError{Path: path, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *ConfigError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidateConfig checks a config more strictly than Setup does, and reports
+// every problem it finds rather than just the first. On top of what Setup
+// checks, it rejects fields Nudger doesn't know about, missing API keys and
+// other fields sources need, StatusPage metric ids used more than once, and
+// page ids that don't look like StatusPage's.
+func ValidateConfig(contents []byte) []Problem {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		if syntax, ok := err.(*json.SyntaxError); ok {
+			line, col := position(contents, syntax.Offset)
+			return []Problem{{App: -1, Message: fmt.Sprintf("line %d, column %d: %s", line, col, err)}}
+		}
+		return []Problem{{App: -1, Message: fmt.Sprintf("expected a list of apps: %s", err)}}
+	}
+
+	var problems []Problem
+	metricIds := make(map[string]string)
+	for i, r := range raw {
+		for _, path := range unknownFields(r, reflect.TypeOf(App{}), "") {
+			problems = append(problems, Problem{App: i, Path: path, Message: "unknown field"})
+		}
+
+		var app App
+		if err := json.Unmarshal(r, &app); err != nil {
+			problems = append(problems, Problem{App: i, Message: err.Error()})
+			continue
+		}
+
+		found := validateStrict(i, app, metricIds)
+		// Only the first of Validate's problems is reported, so it is left
+		// until the strict checks, which find them all, have passed.
+		if len(found) == 0 {
+			err := app.Validate()
+			if e, ok := err.(*ConfigError); ok {
+				found = append(found, Problem{App: i, Path: e.Path, Message: e.Message})
+			} else if err != nil {
+				found = append(found, Problem{App: i, Message: err.Error()})
+			}
+		}
+		problems = append(problems, found...)
+	}
+	return problems
+}
+
+// validateStrict checks the app i for problems Setup lets through. metricIds
+// maps the StatusPage metric ids seen so far to where they were seen.
+func validateStrict(i int, app App, metricIds map[string]string) []Problem {
+	var problems []Problem
+	add := func(path string, format string, args ...interface{}) {
+		problems = append(problems, Problem{App: i, Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if _, ok := Sources[app.SourceName()]; !ok {
+		add("source", "unknown source %q", app.Source)
+	}
+	// The fields each source needs to know where to poll, and as who.
+	missing := func(path string, empty bool) {
+		if empty {
+			add(path, "missing")
+		}
+	}
+	switch app.SourceName() {
+	case "newrelic":
+		missing("nr_api_key", app.NRApiKey == "")
+	case "insights":
+		missing("nr_account_id", app.NRAccountId == 0)
+		missing("nr_query_key", app.NRQueryKey == "")
+	case "nerdgraph":
+		missing("nr_api_key", app.NRApiKey == "")
+		missing("nr_account_id", app.NRAccountId == 0)
+	case "prometheus":
+		missing("prometheus_url", app.PrometheusURL == "")
+	case "httpjson":
+		missing("url", app.URL == "")
+	}
+
+	statuspage := len(app.Components) > 0 || len(app.Incidents) > 0
+	for _, target := range app.SinkConfigs() {
+		if target.Type == "statuspage" {
+			statuspage = true
+		}
+	}
+	if statuspage && app.SPApiKey == "" {
+		add("sp_api_key", "missing")
+	}
+	if app.SPPageId != "" && !spPageId.MatchString(app.SPPageId) {
+		add("sp_page_id", "%q doesn't look like a StatusPage page id", app.SPPageId)
+	}
+
+	for _, key := range app.MetricKeys() {
+		m := app.SPMetrics[key]
+		path := "metrics." + key
+		if app.SourceName() == "newrelic" && m.MetricName == "" {
+			if _, ok := SummaryFields[key]; !ok {
+				add(path, "unknown metric %q", key)
+			}
+		}
+		if m.SPMetricId == "" {
+			if statuspage {
+				add(path, "missing sp_metric_id")
+			}
+			continue
+		}
+		where := fmt.Sprintf("$[%d].%s", i, path)
+		if first, ok := metricIds[m.SPMetricId]; ok {
+			add(path, "sp_metric_id %q is already used by %s", m.SPMetricId, first)
+			continue
+		}
+		metricIds[m.SPMetricId] = where
+	}
+	return problems
+}
+
+// unknownFields returns the paths of fields in raw that t has no place for.
+func unknownFields(raw json.RawMessage, t reflect.Type, path string) []string {
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		// Anything but an object, like a metric given as just its id, is
+		// left to the decoder to accept or reject.
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil
+		}
+		known := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if field.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			known[name] = field.Type
+		}
+		for _, key := range sortedKeys(fields) {
+			ft, ok := known[key]
+			if !ok {
+				unknown = append(unknown, joinPath(path, key))
+				continue
+			}
+			unknown = append(unknown, unknownFields(fields[key], ft, joinPath(path, key))...)
+		}
+	case reflect.Slice:
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil
+		}
+		for i, item := range items {
+			unknown = append(unknown, unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Map:
+		var items map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil
+		}
+		for _, key := range sortedKeys(items) {
+			unknown = append(unknown, unknownFields(items[key], t.Elem(), joinPath(path, key))...)
+		}
+	}
+	return unknown
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// position returns the line and column of the byte at offset.
+func position(contents []byte, offset int64) (int, int) {
+	if offset > int64(len(contents)) {
+		offset = int64(len(contents))
+	}
+	line, col := 1, 1
+	for _, b := range contents[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+	return line, col
+}
+
+// Validate checks the config at path, reports any problems to w, and returns
+// the status `nudger validate` should exit with.
+func Validate(path string, w io.Writer) int {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(w, "%s: couldn't read contents: %s\n", path, err)
+		return ValidateUnusable
+	}
+	problems := ValidateConfig(contents)
+	for _, p := range problems {
+		fmt.Fprintf(w, "%s: %s\n", path, p)
+	}
+	if len(problems) > 0 {
+		noun := "problems"
+		if len(problems) == 1 {
+			noun = "problem"
+		}
+		fmt.Fprintf(w, "%s: %d %s found\n", path, len(problems), noun)
+		return ValidateProblems
+	}
+	fmt.Fprintf(w, "%s: OK\n", path)
+	return ValidateOK
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	config := `[
+  {
+    "nr_api_key": "key",
+    "nr_app_id": 1,
+    "sp_api_key": "key",
+    "sp_page_id": "trx08hfqyabc",
+    "metrics": {
+      "response_time": "abcw0cv8wh6l",
+      "error_rate": {"sp_metric_id": "defd9hl632ch", "nmae": "Errors/all"}
+    },
+    "sinks": [{"type": "statuspage", "ulr": "http://example.com"}]
+  },
+  {
+    "nr_app_id": 2,
+    "sp_page_id": "Not A Page",
+    "metrics": {
+      "response_time": "abcw0cv8wh6l",
+      "uptime": "ghizztk3p4t4"
+    },
+    "surce": "prometheus"
+  }
+]`
+	var problems []string
+	for _, p := range ValidateConfig([]byte(config)) {
+		problems = append(problems, p.String())
+	}
+	expected := []string{
+		`$[0].metrics.error_rate.nmae: unknown field`,
+		`$[0].sinks[0].ulr: unknown field`,
+		`$[1].surce: unknown field`,
+		`$[1].nr_api_key: missing`,
+		`$[1].sp_api_key: missing`,
+		`$[1].sp_page_id: "Not A Page" doesn't look like a StatusPage page id`,
+		`$[1].metrics.response_time: sp_metric_id "abcw0cv8wh6l" is already used by $[0].metrics.response_time`,
+		`$[1].metrics.uptime: unknown metric "uptime"`,
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("Expected problems:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+}
+
+func TestValidateConfigSourceKeys(t *testing.T) {
+	config := `[
+  {"source": "insights", "metrics": {"errors": {"nrql": "SELECT count(*) FROM TransactionError"}}, "sinks": [{"type": "webhook", "url": "http://localhost/"}]},
+  {"source": "nerdgraph", "metrics": {"errors": {"nrql": "SELECT count(*) FROM TransactionError"}}, "sinks": [{"type": "webhook", "url": "http://localhost/"}]},
+  {"source": "prometheus", "metrics": {"up": {"query": "up"}}, "sinks": [{"type": "webhook", "url": "http://localhost/"}]},
+  {"source": "httpjson", "metrics": {"depth": {"path": "queue.depth"}}, "sinks": [{"type": "webhook", "url": "http://localhost/"}]}
+]`
+	var problems []string
+	for _, p := range ValidateConfig([]byte(config)) {
+		problems = append(problems, p.String())
+	}
+	expected := []string{
+		`$[0].nr_account_id: missing`,
+		`$[0].nr_query_key: missing`,
+		`$[1].nr_api_key: missing`,
+		`$[1].nr_account_id: missing`,
+		`$[2].prometheus_url: missing`,
+		`$[3].url: missing`,
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("Expected problems:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+}
+
+func TestValidateConfigPaths(t *testing.T) {
+	config := `[
+  {"nr_api_key": "key", "nr_app_id": 1, "sp_api_key": "key", "sp_page_id": "trx08hfqyabc",
+    "metrics": {"throughput": "ghizztk3p4t4"},
+    "components": [{"metric": "error_rate", "component_id": "api", "thresholds": {"major_outage": 5}}]},
+  {"source": "prometheus", "prometheus_url": "http://localhost:9090", "sp_api_key": "key", "sp_page_id": "trx08hfqyabc",
+    "metrics": {"up": {"sp_metric_id": "abcw0cv8wh6l"}}}
+]`
+	var problems []string
+	for _, p := range ValidateConfig([]byte(config)) {
+		problems = append(problems, p.String())
+	}
+	expected := []string{
+		`$[0].components[0].metric: unknown metric "error_rate"`,
+		`$[1].metrics.up: missing query`,
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Fatalf("Expected problems:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(problems, "\n"))
+	}
+}
+
+func TestValidateConfigReportsSyntaxErrors(t *testing.T) {
+	config := "[\n  {\n    \"metrics\": {\n      \"response_time\": \"abcw0cv8wh6l\",\n    }\n  }\n]"
+	problems := ValidateConfig([]byte(config))
+	if len(problems) != 1 || !strings.HasPrefix(problems[0].String(), "line 5, column 6:") {
+		t.Fatalf("Expected a syntax error on line 5, got %v", problems)
+	}
+}
+
+func TestValidateExitCodes(t *testing.T) {
+	f, err := ioutil.TempFile("", "nudger.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	for _, c := range []struct {
+		config string
+		status int
+	}{
+		{`[{"nr_api_key": "key", "nr_app_id": 1, "sp_api_key": "key", "sp_page_id": "trx08hfqyabc", "metrics": {"throughput": "ghizztk3p4t4"}}]`, ValidateOK},
+		{`[{"nr_app_id": 1}]`, ValidateProblems},
+	} {
+		if err := ioutil.WriteFile(f.Name(), []byte(c.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if status := Validate(f.Name(), &out); status != c.status {
+			t.Fatalf("Expected %s to exit with %d, got %d: %s", c.config, c.status, status, out.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if status := Validate(f.Name()+".missing", &out); status != ValidateUnusable {
+		t.Fatalf("Expected a missing config to exit with %d, got %d", ValidateUnusable, status)
+	}
+}
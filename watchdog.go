@@ -0,0 +1,163 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+var watchdogCounts = expvar.NewMap("watchdog")
+
+// What the watchdog can do with a stale metric.
+const (
+	StaleSkip     = "skip"
+	StaleSentinel = "sentinel"
+	StaleDegrade  = "degrade"
+)
+
+// StalenessConfig is an app's "staleness" config. It tells the watchdog to
+// look out for metrics that can't be trusted: those from a New Relic app that
+// has stopped reporting, or that haven't changed in UnchangedPolls polls.
+type StalenessConfig struct {
+	// Policy is what to do with stale metrics: skip them, push Sentinel in
+	// their place, or not push them and put ComponentId in ComponentStatus
+	// until they are fresh again. Staleness isn't checked without one.
+	Policy          string  `json:"policy"`
+	UnchangedPolls  int     `json:"unchanged_polls"`
+	Sentinel        float64 `json:"sentinel"`
+	ComponentId     string  `json:"component_id"`
+	ComponentStatus string  `json:"component_status"`
+}
+
+func validateStaleness(app App) error {
+	s := app.Staleness
+	switch s.Policy {
+	case "", StaleSkip, StaleSentinel:
+	case StaleDegrade:
+		if s.ComponentId == "" {
+			return configError("staleness.component_id", "missing")
+		}
+		if s.ComponentStatus != "" && severity(s.ComponentStatus) < 1 {
+			return configError("staleness.component_status", "unknown status %q", s.ComponentStatus)
+		}
+	default:
+		return configError("staleness.policy", "unknown policy %q", s.Policy)
+	}
+	if s.UnchangedPolls < 0 {
+		return configError("staleness.unchanged_polls", "can't be negative")
+	}
+	return nil
+}
+
+// staleStatus returns the status to put the app's staleness component in.
+func (s StalenessConfig) staleStatus() string {
+	if s.ComponentStatus == "" {
+		return "degraded_performance"
+	}
+	return s.ComponentStatus
+}
+
+// SteadyFields are the New Relic summary fields that normally hold steady on
+// a healthy app, and so aren't checked against UnchangedPolls.
+var SteadyFields = map[string]bool{
+	"apdex_target":   true,
+	"host_count":     true,
+	"instance_count": true,
+}
+
+// steady returns whether the app's metric is expected not to change.
+func (app App) steady(key string) bool {
+	return app.SourceName() == "newrelic" && app.SPMetrics[key].MetricName == "" && SteadyFields[key]
+}
+
+type unchanged struct {
+	value float64
+	polls int
+}
+
+// Watchdog catches stale metrics as they are polled, and applies their app's
+// staleness policy to them.
+type Watchdog struct {
+	mu sync.Mutex
+	// seen maps app/metric key to how long its value has stayed the same.
+	seen map[string]*unchanged
+}
+
+func NewWatchdog() *Watchdog {
+	return &Watchdog{seen: make(map[string]*unchanged)}
+}
+
+var watchdog = NewWatchdog()
+
+// stale returns why the metric is stale, or "" if it isn't.
+func (w *Watchdog) stale(app App, m Metric) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := app.Name() + "\x00" + m.Key
+	u, ok := w.seen[key]
+	if !ok || u.value != m.Value {
+		u = &unchanged{value: m.Value}
+		w.seen[key] = u
+	}
+	u.polls++
+
+	switch {
+	case m.notReporting:
+		return "not_reporting"
+	case app.Staleness.UnchangedPolls > 0 && u.polls > app.Staleness.UnchangedPolls && !app.steady(m.Key):
+		return "unchanged"
+	}
+	return ""
+}
+
+// Check returns the metrics to send on from a poll of the app, having dealt
+// with any stale ones.
+func (w *Watchdog) Check(app App, metrics []Metric) []Metric {
+	// Initialise metrics
+	watchdogCounts.Add("stale.not_reporting", 0)
+	watchdogCounts.Add("stale.unchanged", 0)
+	watchdogCounts.Add("skipped", 0)
+	watchdogCounts.Add("sentinels", 0)
+	watchdogCounts.Add("degraded", 0)
+
+	s := app.Staleness
+	if s.Policy == "" {
+		return metrics
+	}
+
+	var checked []Metric
+	for _, m := range metrics {
+		reason := w.stale(app, m)
+		if s.Policy == StaleDegrade {
+			// The rule is there whether or not the metric is stale, so that
+			// the component recovers once it isn't.
+			m.Components = append(m.Components, ComponentRule{Metric: m.Key, ComponentId: s.ComponentId, StaleStatus: s.staleStatus()})
+		}
+		if reason == "" {
+			checked = append(checked, m)
+			continue
+		}
+
+		log.Printf("[info] Watchdog: metric %s for app %s is stale (%s), applying policy %s\n", m.Key, app.Name(), reason, s.Policy)
+		watchdogCounts.Add("stale."+reason, 1)
+		switch s.Policy {
+		case StaleSkip:
+			watchdogCounts.Add("skipped", 1)
+			continue
+		case StaleSentinel:
+			watchdogCounts.Add("sentinels", 1)
+			m.Value = s.Sentinel
+			m.Sentinel = true
+			// The stale value's timestamp may be from whenever the app
+			// last reported.
+			m.Timestamp = time.Now()
+		case StaleDegrade:
+			watchdogCounts.Add("degraded", 1)
+			m.Stale = true
+		}
+		checked = append(checked, m)
+	}
+	return checked
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchdogUnchanged(t *testing.T) {
+	w := NewWatchdog()
+	app := App{NRAppId: 1, Staleness: StalenessConfig{Policy: StaleSkip, UnchangedPolls: 2}}
+
+	for i, expected := range []int{1, 1, 0, 1} {
+		value := 5.0
+		if i == 3 {
+			value = 6
+		}
+		checked := w.Check(app, []Metric{{Key: "response_time", Value: value}})
+		if len(checked) != expected {
+			t.Fatalf("Poll %d: expected %d metrics, got %d", i, expected, len(checked))
+		}
+	}
+}
+
+func TestWatchdogSentinel(t *testing.T) {
+	w := NewWatchdog()
+	app := App{NRAppId: 1, Staleness: StalenessConfig{Policy: StaleSentinel, Sentinel: -1}}
+
+	reported := time.Now().Add(-time.Hour)
+	checked := w.Check(app, []Metric{{Key: "response_time", Value: 0, Timestamp: reported, notReporting: true}, {Key: "throughput", Value: 12, Timestamp: reported}})
+	if len(checked) != 2 || checked[0].Value != -1 || checked[1].Value != 12 {
+		t.Fatalf("Expected the sentinel in place of the stale metric only, got %+v", checked)
+	}
+	if !checked[0].Sentinel || checked[1].Sentinel {
+		t.Fatalf("Expected only the sentinel to be marked, got %+v", checked)
+	}
+	if time.Since(checked[0].Timestamp) > time.Minute || !checked[1].Timestamp.Equal(reported) {
+		t.Fatalf("Expected the sentinel to be timestamped now, got %+v", checked)
+	}
+}
+
+func TestWatchdogSentinelSkipsRules(t *testing.T) {
+	components := make(chan string, 10)
+	sp := MockStatusPageComponents(components)
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+	d := NewComponentDispatcher()
+	incidents := NewIncidentDispatcher()
+	w := NewWatchdog()
+	app := App{NRAppId: 1, SPPageId: "page", Staleness: StalenessConfig{Policy: StaleSentinel, Sentinel: 1000}}
+	m := Metric{Key: "response_time", SPPageId: "page", notReporting: true}
+	m.Components = []ComponentRule{{Metric: "response_time", ComponentId: "api", Thresholds: map[string]float64{"major_outage": 500}}}
+	m.Incidents = []IncidentRule{{Metric: "response_time", Threshold: 500}}
+
+	checked := w.Check(app, []Metric{m})
+	d.Update(config, checked[0])
+	incidents.Update(config, checked[0])
+	if len(components) != 0 {
+		t.Fatalf("Expected a sentinel not to change components, got '%s'", <-components)
+	}
+}
+
+func TestWatchdogSteadyFields(t *testing.T) {
+	w := NewWatchdog()
+	app := App{NRAppId: 1, SPMetrics: map[string]MetricConfig{"host_count": {SPMetricId: "hosts"}, "throughput": {SPMetricId: "rpm"}},
+		Staleness: StalenessConfig{Policy: StaleSkip, UnchangedPolls: 1}}
+
+	var checked []Metric
+	for i := 0; i < 3; i++ {
+		checked = w.Check(app, []Metric{{Key: "host_count", Value: 4}, {Key: "throughput", Value: 100}})
+	}
+	if len(checked) != 1 || checked[0].Key != "host_count" {
+		t.Fatalf("Expected only the unchanged throughput to be stale, got %+v", checked)
+	}
+}
+
+func TestWatchdogIgnoredWithoutPolicy(t *testing.T) {
+	w := NewWatchdog()
+	checked := w.Check(App{NRAppId: 1}, []Metric{{Key: "response_time", notReporting: true}})
+	if len(checked) != 1 {
+		t.Fatalf("Expected staleness not to be checked without a policy, got %+v", checked)
+	}
+}
+
+func TestWatchdogDegradesComponent(t *testing.T) {
+	requests := make(chan string, 10)
+	sp := MockStatusPageComponents(requests)
+	defer sp.Close()
+
+	config := Config{SPBaseURL: sp.URL + "/v1"}
+	d := NewComponentDispatcher()
+	w := NewWatchdog()
+	app := App{NRAppId: 1, SPPageId: "page", Staleness: StalenessConfig{Policy: StaleDegrade, ComponentId: "api"}}
+
+	for _, c := range []struct {
+		reporting bool
+		expected  string
+	}{
+		{false, "PATCH /v1/pages/page/components/api.json degraded_performance"},
+		{true, "PATCH /v1/pages/page/components/api.json operational"},
+	} {
+		checked := w.Check(app, []Metric{{Key: "response_time", SPPageId: "page", notReporting: !c.reporting}})
+		if len(checked) != 1 || checked[0].Stale == c.reporting {
+			t.Fatalf("Expected the metric to be stale: %t, got %+v", !c.reporting, checked)
+		}
+		d.Update(config, checked[0])
+		select {
+		case request := <-requests:
+			if request != c.expected {
+				t.Fatalf("Expected '%s', got '%s'", c.expected, request)
+			}
+		default:
+			t.Fatalf("Expected '%s', got nothing", c.expected)
+		}
+	}
+}
+
+func TestNewRelicNotReporting(t *testing.T) {
+	nr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := ApplicationResponse{}
+		response.Application.Reporting = false
+		b, _ := json.Marshal(response)
+		w.Write(b)
+	}))
+	defer nr.Close()
+
+	config := Config{NRBaseURL: nr.URL + "/v2/applications/"}
+	metrics := make(chan Metric, 1)
+	app := App{NRAppId: 987654, SPMetrics: map[string]MetricConfig{"response_time": {SPMetricId: "rt"}}, Staleness: StalenessConfig{Policy: StaleSkip}}
+	PollNR(config, app, metrics)
+	select {
+	case m := <-metrics:
+		t.Fatalf("Expected the metric of a non-reporting app to be skipped, got %+v", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestAppValidateStaleness(t *testing.T) {
+	for _, s := range []StalenessConfig{
+		{Policy: "ignore"},
+		{Policy: StaleDegrade},
+		{Policy: StaleDegrade, ComponentId: "api", ComponentStatus: "broken"},
+		{Policy: StaleSkip, UnchangedPolls: -1},
+	} {
+		app := App{NRAppId: 1, SPPageId: "page", Staleness: s}
+		if err := app.Validate(); err == nil {
+			t.Fatalf("Expected an error for %+v, got nil", s)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+var webhookCounts = expvar.NewMap("webhook")
+
+// WebhookPayload is the JSON document POSTed to a webhook for each metric.
+type WebhookPayload struct {
+	Key        string  `json:"key"`
+	SPPageId   string  `json:"sp_page_id"`
+	SPMetricId string  `json:"sp_metric_id"`
+	Timestamp  int64   `json:"timestamp"`
+	Value      float64 `json:"value"`
+}
+
+// Webhook is the Sink that POSTs each metric as JSON to an arbitrary URL, for
+// mirroring public metrics onto internal dashboards.
+type Webhook struct{}
+
+// Validate checks that the sink has somewhere to send metrics.
+func (Webhook) Validate(target SinkConfig, app App) error {
+	if target.URL == "" {
+		return fmt.Errorf("webhook sink: missing url")
+	}
+	return nil
+}
+
+func (Webhook) Publish(config Config, target SinkConfig, metric Metric) error {
+	// Initialise metrics
+	webhookCounts.Add("errors.json.marshal", 0)
+	webhookCounts.Add("errors.http.new", 0)
+	webhookCounts.Add("errors.http.do", 0)
+	webhookCounts.Add("errors.http.status", 0)
+	webhookCounts.Add("requests", 0)
+
+	payload := WebhookPayload{
+		Key:        metric.Key,
+		SPPageId:   metric.SPPageId,
+		SPMetricId: metric.SPMetricId,
+		Timestamp:  metric.Time().Unix(),
+		Value:      metric.Value,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		webhookCounts.Add("errors.json.marshal", 1)
+		return fmt.Errorf("JSON marshal: %s", err)
+	}
+	if config.Debug {
+		log.Printf("[debug] Dispatch: webhook %s: %s", target.URL, string(body))
+	}
+
+	client := config.HTTPClient()
+	req, err := http.NewRequest("POST", target.URL, bytes.NewReader(body))
+	if err != nil {
+		webhookCounts.Add("errors.http.new", 1)
+		return fmt.Errorf("new request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range target.Headers {
+		req.Header.Set(name, value)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	requestLatency.Since(start, "webhook")
+	if err != nil {
+		webhookCounts.Add("errors.http.do", 1)
+		return &RetryableError{Err: fmt.Errorf("client do: %s", err)}
+	}
+	defer resp.Body.Close()
+	webhookCounts.Add("requests", 1)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ = ioutil.ReadAll(resp.Body)
+		webhookCounts.Add("errors.http.status", 1)
+		return NewStatusError("webhook "+target.URL, resp, body)
+	}
+	return nil
+}